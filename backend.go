@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backendGCS stores the volumes on Google Cloud Storage
+	backendGCS = "gcs"
+	// backendS3 stores the volumes on an S3 compatible object storage
+	backendS3 = "s3"
+)
+
+var (
+	// errBucketNotFound is returned by a BucketBackend when a bucket does not exist
+	errBucketNotFound = errors.New("bucket not found")
+	// errBucketForbidden is returned by a BucketBackend when a bucket exists but is not accessible,
+	// it is usually owned by another project or account since bucket names are globally unique
+	errBucketForbidden = errors.New("bucket not accessible")
+	// errObjectNotFound is returned by a BucketBackend when an object does not exist
+	errObjectNotFound = errors.New("object not found")
+)
+
+// BucketBackend is the object storage holding the buckets behind the driver volumes
+type BucketBackend interface {
+	// BucketExists returns true if a bucket exists, errBucketForbidden if it exists but is not accessible
+	BucketExists(bucketName string) (bool, error)
+	// CreateBucket creates a bucket, the backend defaults are used for the options left empty
+	CreateBucket(bucketName string, opts *bucketOptions) error
+	// DeleteBucket deletes an empty bucket
+	DeleteBucket(bucketName string) error
+	// ListObjectVersions walks page by page all the versions of the objects stored in a bucket under a prefix,
+	// all of them if the prefix is empty
+	ListObjectVersions(bucketName, prefix string, page func([]objectVersion) error) error
+	// ListPrefixes returns the top level "directories" of a bucket, i.e. the object name prefixes ending with "/"
+	ListPrefixes(bucketName string) ([]string, error)
+	// GetObject reads an object from a bucket, errObjectNotFound if it does not exist
+	GetObject(bucketName, objectName string) ([]byte, error)
+	// PutObject writes an object into a bucket
+	PutObject(bucketName, objectName string, data []byte) error
+	// DeleteObjectVersion permanently deletes a version of an object, errObjectNotFound if it does not exist
+	DeleteObjectVersion(bucketName string, o objectVersion) error
+	// ListBuckets returns the names of the buckets starting with a prefix
+	ListBuckets(prefix string) ([]string, error)
+	// StatBucket returns the attributes of a bucket, errBucketNotFound if it does not exist,
+	// errBucketForbidden if it is not accessible
+	StatBucket(bucketName string) (*bucketInfo, error)
+	// SetBucketLabels adds labels to a bucket
+	SetBucketLabels(bucketName string, labels map[string]string) error
+}
+
+// objectVersion is a version of an object of a bucket
+type objectVersion struct {
+	Name string
+	// Version is the GCS generation or the S3 version ID of the object, the live object if empty
+	Version string
+}
+
+// bucketInfo describes a bucket of a BucketBackend
+type bucketInfo struct {
+	Name         string
+	Location     string
+	StorageClass string
+	Created      time.Time
+	Labels       map[string]string
+}
+
+// bucketOptions defines the location & storage class of a bucket, empty fields are not defined
+type bucketOptions struct {
+	Location     string
+	StorageClass string
+}
+
+// gcsStorageClasses are the storage classes accepted for GCStorage buckets
+var gcsStorageClasses = map[string]bool{
+	"STANDARD": true,
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+	"REGIONAL": true,
+}
+
+// bucketLocationRegexp matches a bucket location: multi-region (US, EU...), region (us-central1...)
+var bucketLocationRegexp = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// parseBucketOptions reads the bucket options of a volume from its creation options
+func parseBucketOptions(backendType string, options map[string]string) (*bucketOptions, error) {
+	opts := &bucketOptions{
+		Location:     options["location"],
+		StorageClass: strings.ToUpper(options["storage_class"]),
+	}
+	if backendType == backendS3 && opts.StorageClass != "" && opts.StorageClass != "STANDARD" {
+		return nil, fmt.Errorf("Invalid storage class %s: S3 buckets only support STANDARD", opts.StorageClass)
+	}
+	if err := validateBucketOptions(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// validateBucketOptions checks the defined bucket options
+func validateBucketOptions(opts *bucketOptions) error {
+	if opts.Location != "" && !bucketLocationRegexp.MatchString(opts.Location) {
+		return fmt.Errorf("Invalid bucket location %s", opts.Location)
+	}
+	if opts.StorageClass != "" && !gcsStorageClasses[opts.StorageClass] {
+		return fmt.Errorf("Invalid storage class %s, use one of STANDARD, NEARLINE, COLDLINE, ARCHIVE, REGIONAL", opts.StorageClass)
+	}
+	return nil
+}
+
+// checkBucketOptions returns an error if an existing bucket conflicts with the defined bucket options,
+// the backend defaults are not checked since they only apply to the buckets created by the driver
+func checkBucketOptions(info *bucketInfo, opts *bucketOptions) error {
+	if opts.Location != "" && !strings.EqualFold(info.Location, opts.Location) {
+		return fmt.Errorf("Bucket %s already exists in location %s, not %s", info.Name, info.Location, opts.Location)
+	}
+	if opts.StorageClass != "" && !strings.EqualFold(info.StorageClass, opts.StorageClass) {
+		return fmt.Errorf("Bucket %s already exists with storage class %s, not %s", info.Name, info.StorageClass, opts.StorageClass)
+	}
+	return nil
+}
+
+// parseBucketPrefix validates the bucket sub-path mounted for a volume
+func parseBucketPrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(prefix, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid bucket prefix %s", prefix)
+		}
+	}
+	return prefix, nil
+}
+
+// volumeBackend couples the object storage & the mounter used by the volumes of a backend type
+type volumeBackend struct {
+	buckets BucketBackend
+	mounter Mounter
+	// bucketPrefix prefixes the names of the buckets created for the volumes
+	bucketPrefix string
+	// sharedBucket is the bucket holding all the volumes as prefixes, a bucket is created per volume if empty
+	sharedBucket string
+}
+
+// s3BucketNameRegexp matches the DNS compliant bucket names accepted by S3
+var s3BucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// backendType returns the backend type of a volume, volumes created before backend selection are on GCS
+func (v *gcsVolumes) backendType() string {
+	if v.Backend == "" {
+		return backendGCS
+	}
+	return v.Backend
+}
+
+// getBackend returns the backend of a backend type
+func (d *gcpVolDriver) getBackend(backendType string) (*volumeBackend, error) {
+	d.backendsMu.RLock()
+	defer d.backendsMu.RUnlock()
+	b, ok := d.backends[backendType]
+	if !ok {
+		return nil, fmt.Errorf("Volume backend %s is not configured", backendType)
+	}
+	return b, nil
+}
+
+// getGCPBucketName defines the name of a GCStorage bucket based on GCP project ID & volume name
+func (d *gcpVolDriver) getGCPBucketName(volumeName string) string {
+	return fmt.Sprintf("%s_%s", d.gcpProjectID, volumeName)
+}
+
+// getBucketNamePrefix returns the prefix of the names of the buckets created for the volumes of a backend type
+func (d *gcpVolDriver) getBucketNamePrefix(backendType string) (string, error) {
+	if backendType != backendS3 {
+		return d.gcpProjectID + "_", nil
+	}
+	b, err := d.getBackend(backendS3)
+	if err != nil {
+		return "", err
+	}
+	return b.bucketPrefix + "-", nil
+}
+
+// getBucketName defines the name of the bucket of a volume according to its backend type
+func (d *gcpVolDriver) getBucketName(backendType, volumeName string) (string, error) {
+	if backendType != backendS3 {
+		return d.getGCPBucketName(volumeName), nil
+	}
+	prefix, err := d.getBucketNamePrefix(backendS3)
+	if err != nil {
+		return "", err
+	}
+	bucketName := prefix + volumeName
+	if !s3BucketNameRegexp.MatchString(bucketName) {
+		return "", fmt.Errorf("Invalid S3 bucket name %s, S3 volume names must be lowercase DNS labels", bucketName)
+	}
+	return bucketName, nil
+}
+
+// emptyBucket empties the content of a bucket under a prefix (all of it if empty), without deleting the bucket itself:
+// every version of the objects is deleted page by page by a pool of workers,
+// the objects already deleted are skipped so an interrupted emptying is resumed by emptying the bucket again
+func (d *gcpVolDriver) emptyBucket(b BucketBackend, bucketName, prefix string) error {
+	log.Printf("Emptying bucket '%s' (prefix '%s')...\n", bucketName, prefix)
+	deleted := 0
+	err := b.ListObjectVersions(bucketName, prefix, func(objects []objectVersion) error {
+		if err := deleteObjectVersions(b, bucketName, objects); err != nil {
+			return err
+		}
+		deleted += len(objects)
+		log.Printf("Emptying bucket '%s': %d object version(s) deleted\n", bucketName, deleted)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Bucket '%s' emptied, %d object version(s) deleted\n", bucketName, deleted)
+	return nil
+}
+
+// emptyBucketWorkers is the number of objects deleted concurrently when emptying a bucket
+const emptyBucketWorkers = 16
+
+// deleteObjectVersions deletes object versions with a pool of workers & returns the first error,
+// the versions already deleted are ignored
+func deleteObjectVersions(b BucketBackend, bucketName string, objects []objectVersion) error {
+	jobs := make(chan objectVersion)
+	errs := make(chan error, emptyBucketWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < emptyBucketWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range jobs {
+				if err := b.DeleteObjectVersion(bucketName, o); err != nil && err != errObjectNotFound {
+					errs <- fmt.Errorf("Deleting object %s (version %s) from bucket %s failed: %s", o.Name, o.Version, bucketName, err)
+					// drain the remaining jobs
+					for range jobs {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for _, o := range objects {
+		jobs <- o
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// handleCreateBucket handles the safe creation of the bucket of a volume from its name,
+// an existing bucket is reused only if it matches the defined bucket options,
+// the buckets created are labeled with the driver ownership labels & the user labels,
+// the labels of the bucket are returned
+func (d *gcpVolDriver) handleCreateBucket(backendType string, id volumeIdentity, volumeName string, opts *bucketOptions, userLabels map[string]string) (string, map[string]string, error) {
+	bucketName, err := d.getBucketName(backendType, volumeName)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := d.getVolumeBackend(backendType, id)
+	if err != nil {
+		return "", nil, err
+	}
+	bucketExist, err := b.buckets.BucketExists(bucketName)
+	if err != nil {
+		if err == errBucketForbidden {
+			return "", nil, fmt.Errorf("Bucket %s already exists but is not accessible, it is likely owned by another project: bucket names are globally unique, choose another volume name", bucketName)
+		}
+		return "", nil, err
+	}
+	if bucketExist {
+		labels, err := d.handleAttachBucket(backendType, id, bucketName, opts)
+		if err != nil {
+			return "", nil, err
+		}
+		return bucketName, labels, nil
+	}
+	if err := b.buckets.CreateBucket(bucketName, opts); err != nil {
+		return "", nil, err
+	}
+	labels := getBucketLabels(volumeName, userLabels)
+	if err := b.buckets.SetBucketLabels(bucketName, labels); err != nil {
+		// an unlabeled bucket would never be deleted by the driver
+		if delErr := b.buckets.DeleteBucket(bucketName); delErr != nil {
+			log.Printf("Deleting unlabeled bucket '%s' failed: %s\n", bucketName, delErr)
+		}
+		return "", nil, err
+	}
+	return bucketName, labels, nil
+}
+
+// handleAttachBucket checks that an existing bucket can back a volume & returns its labels
+func (d *gcpVolDriver) handleAttachBucket(backendType string, id volumeIdentity, bucketName string, opts *bucketOptions) (map[string]string, error) {
+	b, err := d.getVolumeBackend(backendType, id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := b.buckets.StatBucket(bucketName)
+	if err != nil {
+		switch err {
+		case errBucketNotFound:
+			return nil, fmt.Errorf("Bucket %s does not exist", bucketName)
+		case errBucketForbidden:
+			return nil, fmt.Errorf("Bucket %s is not accessible with the driver credentials", bucketName)
+		}
+		return nil, err
+	}
+	if err := checkBucketOptions(info, opts); err != nil {
+		return nil, err
+	}
+	labels := info.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	return labels, nil
+}
+
+// handleRemoveBucket handles the safe deletion of the bucket of a volume,
+// only the buckets labeled as owned by the driver are emptied & deleted
+func (d *gcpVolDriver) handleRemoveBucket(v *gcsVolumes) error {
+	b, err := d.getVolumeBackend(v.backendType(), v.identity())
+	if err != nil {
+		return err
+	}
+	bucketName := v.GcsBucketName
+	if v.SharedBucket {
+		// only the volume prefix is emptied, the shared bucket is kept
+		if v.CleanCloud {
+			return d.emptyBucket(b.buckets, bucketName, v.Prefix+"/")
+		}
+		return nil
+	}
+	if v.ExternalBucket {
+		log.Printf("Bucket '%s' was attached to the volume, it is kept\n", bucketName)
+		return nil
+	}
+	if !v.CleanCloud {
+		return nil
+	}
+	info, err := b.buckets.StatBucket(bucketName)
+	if err != nil {
+		if err == errBucketNotFound {
+			return nil
+		}
+		return err
+	}
+	if !isDriverOwned(info.Labels) {
+		log.Printf("Bucket '%s' has no %s=%s label, it was not created by the driver & is kept\n", bucketName, labelOwner, driverID)
+		return nil
+	}
+	// Empty the bucket
+	if err := d.emptyBucket(b.buckets, bucketName, ""); err != nil {
+		return err
+	}
+	// Delete the bucket
+	return b.buckets.DeleteBucket(bucketName)
+}
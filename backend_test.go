@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestParseBucketOptions(t *testing.T) {
+	tests := []struct {
+		backendType string
+		options     map[string]string
+		expected    bucketOptions
+		err         string
+	}{
+		{backendGCS, map[string]string{}, bucketOptions{}, ""},
+		{backendGCS, map[string]string{"location": "EU", "storage_class": "coldline"}, bucketOptions{Location: "EU", StorageClass: "COLDLINE"}, ""},
+		{backendGCS, map[string]string{"location": "europe-west1"}, bucketOptions{Location: "europe-west1"}, ""},
+		{backendGCS, map[string]string{"location": "eu/west"}, bucketOptions{}, "Invalid bucket location eu/west"},
+		{backendGCS, map[string]string{"storage_class": "GLACIER"}, bucketOptions{}, "Invalid storage class GLACIER"},
+		{backendS3, map[string]string{"location": "eu-west-1", "storage_class": "standard"}, bucketOptions{Location: "eu-west-1", StorageClass: "STANDARD"}, ""},
+		{backendS3, map[string]string{"storage_class": "NEARLINE"}, bucketOptions{}, "Invalid storage class NEARLINE: S3 buckets only support STANDARD"},
+	}
+	for _, test := range tests {
+		opts, err := parseBucketOptions(test.backendType, test.options)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("parseBucketOptions(%s, %v): error %v, expected %s", test.backendType, test.options, err, test.err)
+			}
+			continue
+		}
+		if err != nil || *opts != test.expected {
+			t.Errorf("parseBucketOptions(%s, %v) = %+v, %v, expected %+v", test.backendType, test.options, opts, err, test.expected)
+		}
+	}
+}
+
+func TestCheckBucketOptions(t *testing.T) {
+	info := &bucketInfo{Name: "bucket", Location: "EU", StorageClass: "STANDARD"}
+	tests := []struct {
+		opts bucketOptions
+		err  string
+	}{
+		// the options left empty, such as the driver defaults, are not checked
+		{bucketOptions{}, ""},
+		{bucketOptions{Location: "eu", StorageClass: "standard"}, ""},
+		{bucketOptions{Location: "US"}, "Bucket bucket already exists in location EU, not US"},
+		{bucketOptions{StorageClass: "COLDLINE"}, "Bucket bucket already exists with storage class STANDARD, not COLDLINE"},
+	}
+	for _, test := range tests {
+		err := checkBucketOptions(info, &test.opts)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("checkBucketOptions(%+v): error %v, expected %q", test.opts, err, test.err)
+		}
+	}
+}
+
+func TestCreateWithConflictingBucketOptions(t *testing.T) {
+	d, buckets, _ := newTestDriver(t)
+	if err := buckets.CreateBucket("external", &bucketOptions{Location: "EU", StorageClass: "NEARLINE"}); err != nil {
+		t.Fatal(err)
+	}
+	res := d.Create(volume.Request{Name: "data", Options: map[string]string{"bucket": "external", "location": "US"}})
+	if res.Err != "Bucket external already exists in location EU, not US" {
+		t.Errorf("creating a volume on a bucket of another location: %q", res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+	// without location nor storage class, the existing bucket is attached as is
+	if res := d.Create(volume.Request{Name: "data", Options: map[string]string{"bucket": "external"}}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+}
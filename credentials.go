@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	gstorage "google.golang.org/api/storage/v1"
+)
+
+const (
+	// credentialsDirName is the dir of the driver root dir holding the gcsfuse key files of the impersonated service accounts
+	credentialsDirName = "_credentials"
+	// iamCredentialsURL is the endpoint of the IAM Credentials API generating the tokens of the impersonated service accounts
+	iamCredentialsURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+)
+
+// serviceAccountRegexp matches the email of a GCP service account
+var serviceAccountRegexp = regexp.MustCompile(`^[a-z0-9-]+@[a-z0-9.-]+\.gserviceaccount\.com$`)
+
+// volumeIdentity is the GCP identity accessing the bucket of a volume, the driver identity if empty
+type volumeIdentity struct {
+	// Credentials is the name of a GCP service key registered with the driver
+	Credentials string
+	// ImpersonateServiceAccount is the email of the service account impersonated with the driver (or Credentials) identity
+	ImpersonateServiceAccount string
+}
+
+// isDefault returns true for the driver identity
+func (id volumeIdentity) isDefault() bool {
+	return id.Credentials == "" && id.ImpersonateServiceAccount == ""
+}
+
+// key returns the unique key of an identity
+func (id volumeIdentity) key() string {
+	return id.Credentials + "|" + id.ImpersonateServiceAccount
+}
+
+// identity returns the GCP identity accessing the bucket of a volume
+func (v *gcsVolumes) identity() volumeIdentity {
+	return volumeIdentity{
+		Credentials:               v.Credentials,
+		ImpersonateServiceAccount: v.ImpersonateServiceAccount,
+	}
+}
+
+// identityBackends creates & caches the volume backends of the per-volume GCP identities
+type identityBackends struct {
+	// credentials are the GCP service key files registered with the driver by name
+	credentials map[string]string
+	newBackend  func(id volumeIdentity) (*volumeBackend, error)
+	mu          sync.Mutex
+	backends    map[string]*volumeBackend
+}
+
+// newIdentityBackends creates the cache of the volume backends of the per-volume GCP identities
+func newIdentityBackends(credentials map[string]string, newBackend func(id volumeIdentity) (*volumeBackend, error)) *identityBackends {
+	return &identityBackends{
+		credentials: credentials,
+		newBackend:  newBackend,
+		backends:    make(map[string]*volumeBackend),
+	}
+}
+
+// get returns the volume backend of an identity, created on first use
+func (i *identityBackends) get(id volumeIdentity) (*volumeBackend, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if b, ok := i.backends[id.key()]; ok {
+		return b, nil
+	}
+	b, err := i.newBackend(id)
+	if err != nil {
+		return nil, err
+	}
+	i.backends[id.key()] = b
+	return b, nil
+}
+
+// reset drops the cached volume backends, created again on next use with the current credentials
+func (i *identityBackends) reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.backends = make(map[string]*volumeBackend)
+}
+
+// parseVolumeIdentity returns the GCP identity defined by the volume options credentials & impersonate_service_account
+func (d *gcpVolDriver) parseVolumeIdentity(backendType string, options map[string]string) (volumeIdentity, error) {
+	id := volumeIdentity{
+		Credentials:               options["credentials"],
+		ImpersonateServiceAccount: options["impersonate_service_account"],
+	}
+	if id.isDefault() {
+		return id, nil
+	}
+	if backendType != backendGCS || d.identities == nil {
+		return id, fmt.Errorf("The credentials & impersonate_service_account options are only supported by the gcs backend")
+	}
+	if id.Credentials != "" {
+		if _, ok := d.identities.credentials[id.Credentials]; !ok {
+			return id, fmt.Errorf("Unknown credentials %s, the credentials must be registered with the driver flag -credentials", id.Credentials)
+		}
+	}
+	if id.ImpersonateServiceAccount != "" && !serviceAccountRegexp.MatchString(id.ImpersonateServiceAccount) {
+		return id, fmt.Errorf("Invalid service account %s", id.ImpersonateServiceAccount)
+	}
+	return id, nil
+}
+
+// getVolumeBackend returns the volume backend of a backend type accessed with a GCP identity
+func (d *gcpVolDriver) getVolumeBackend(backendType string, id volumeIdentity) (*volumeBackend, error) {
+	if id.isDefault() {
+		return d.getBackend(backendType)
+	}
+	if backendType != backendGCS || d.identities == nil {
+		return nil, fmt.Errorf("Per-volume credentials are only supported by the gcs backend")
+	}
+	return d.identities.get(id)
+}
+
+// impersonatedTokenSource gets the tokens of an impersonated service account from the IAM Credentials API
+type impersonatedTokenSource struct {
+	// client is authenticated with the identity impersonating the service account
+	client         *http.Client
+	serviceAccount string
+}
+
+// newImpersonatedTokenSource creates the token source of a service account impersonated with the identity of a token source
+func newImpersonatedTokenSource(source oauth2.TokenSource, serviceAccount string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		client:         oauth2.NewClient(oauth2.NoContext, source),
+		serviceAccount: serviceAccount,
+	})
+}
+
+// Token generates an access token of the impersonated service account
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"scope":    []string{gstorage.CloudPlatformScope},
+		"lifetime": "3600s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Post(iamCredentialsURL+url.PathEscape(s.serviceAccount)+":generateAccessToken", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, fmt.Errorf("Impersonation of service account %s failed: %s", s.serviceAccount, err)
+	}
+	var res struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: res.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      res.ExpireTime,
+	}, nil
+}
+
+// writeImpersonationKeyFile writes the gcsfuse key file of an identity impersonating a service account with a source key file,
+// the Application Default Credentials file is the source if the source key file is empty;
+// the file name holds a hash of the identity since several credentials can impersonate the same service account
+func writeImpersonationKeyFile(driverRootDir, sourceKeyPath string, id volumeIdentity) (string, error) {
+	serviceAccount := id.ImpersonateServiceAccount
+	if sourceKeyPath == "" {
+		sourceKeyPath = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if sourceKeyPath == "" {
+		return "", fmt.Errorf("Impersonating %s with gcsfuse requires a service account key: -gcp-key-json, credentials or $GOOGLE_APPLICATION_CREDENTIALS", serviceAccount)
+	}
+	source, err := ioutil.ReadFile(sourceKeyPath)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"type":                              "impersonated_service_account",
+		"service_account_impersonation_url": iamCredentialsURL + serviceAccount + ":generateAccessToken",
+		"source_credentials":                json.RawMessage(source),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(driverRootDir, credentialsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(id.key()))
+	path := filepath.Join(dir, "impersonate-"+serviceAccount+"-"+hex.EncodeToString(hash[:8])+".json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	log.Printf("gcsfuse key file impersonating service account %s written to %s\n", serviceAccount, path)
+	return path, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteImpersonationKeyFilePerIdentity(t *testing.T) {
+	rootDir := t.TempDir()
+	const serviceAccount = "reports@my-project.iam.gserviceaccount.com"
+	paths := make(map[string]string)
+	for _, credentials := range []string{"", "data-team"} {
+		sourceKeyPath := filepath.Join(t.TempDir(), "key.json")
+		if err := ioutil.WriteFile(sourceKeyPath, []byte(`{"type": "service_account", "client_email": "`+credentials+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		path, err := writeImpersonationKeyFile(rootDir, sourceKeyPath, volumeIdentity{Credentials: credentials, ImpersonateServiceAccount: serviceAccount})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(path) != filepath.Join(rootDir, credentialsDirName) {
+			t.Errorf("key file %s outside of the credentials dir", path)
+		}
+		paths[credentials] = path
+	}
+	if paths[""] == paths["data-team"] {
+		t.Fatalf("identities impersonating %s share the key file %s", serviceAccount, paths[""])
+	}
+	// each key file keeps the source credentials of its identity
+	for credentials, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keyFile struct {
+			Source struct {
+				ClientEmail string `json:"client_email"`
+			} `json:"source_credentials"`
+		}
+		if err := json.Unmarshal(data, &keyFile); err != nil {
+			t.Fatal(err)
+		}
+		if keyFile.Source.ClientEmail != credentials {
+			t.Errorf("key file %s has the source credentials %q instead of %q", path, keyFile.Source.ClientEmail, credentials)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// dirMounter is a Mounter which only creates the host mountpoint directories & tracks them as mounted,
+// used to run the driver without FUSE
+type dirMounter struct {
+	mu      sync.Mutex
+	mounted map[string]string
+}
+
+// newDirMounter creates a directory mounter without any mounted directory
+func newDirMounter() *dirMounter {
+	return &dirMounter{
+		mounted: make(map[string]string),
+	}
+}
+
+// Mount creates the host mountpoint & references it as mounted on the volume bucket
+func (m *dirMounter) Mount(v *gcsVolumes, mountpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if bucketName, ok := m.mounted[mountpoint]; ok {
+		return fmt.Errorf("%s is already mounted on bucket %s", mountpoint, bucketName)
+	}
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return err
+	}
+	m.mounted[mountpoint] = v.GcsBucketName
+	return nil
+}
+
+// Unmount dereferences a mounted host mountpoint
+func (m *dirMounter) Unmount(mountpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.mounted[mountpoint]; !ok {
+		return fmt.Errorf("%s is not mounted", mountpoint)
+	}
+	delete(m.mounted, mountpoint)
+	return nil
+}
+
+// isMounted returns true if a host mountpoint is mounted
+func (m *dirMounter) isMounted(mountpoint string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.mounted[mountpoint]
+	return ok
+}
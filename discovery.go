@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// getBackendTypes returns the sorted types of the configured backends
+func (d *gcpVolDriver) getBackendTypes() []string {
+	d.backendsMu.RLock()
+	defer d.backendsMu.RUnlock()
+	var types []string
+	for backendType := range d.backends {
+		types = append(types, backendType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// remoteVolumesTTL is how long the volumes found on the backends are cached, Docker lists them on every `docker volume ls`
+const remoteVolumesTTL = 30 * time.Second
+
+// remoteVolumesCache caches the names of the volumes found on the backends
+type remoteVolumesCache struct {
+	// mu guards the fields & serializes the listings of the backends
+	mu      sync.Mutex
+	ttl     time.Duration
+	names   []string
+	expires time.Time
+}
+
+// invalidate drops the cached volumes, the next listing is read from the backends
+func (c *remoteVolumesCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expires = time.Time{}
+}
+
+// listRemoteVolumes returns the names of the volumes found on the backends, cached for remoteVolumesTTL
+func (d *gcpVolDriver) listRemoteVolumes() ([]string, error) {
+	c := d.remoteVolumes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.expires) {
+		return c.names, nil
+	}
+	names, err := d.scanRemoteVolumes()
+	if err != nil {
+		return nil, err
+	}
+	c.names = names
+	c.expires = time.Now().Add(c.ttl)
+	return names, nil
+}
+
+// scanRemoteVolumes returns the names of the volumes found on the backends, which may have been created by other hosts:
+// the prefixes of the shared buckets & the buckets named after the driver naming convention
+func (d *gcpVolDriver) scanRemoteVolumes() ([]string, error) {
+	var names []string
+	for _, backendType := range d.getBackendTypes() {
+		b, err := d.getBackend(backendType)
+		if err != nil {
+			return nil, err
+		}
+		if b.sharedBucket != "" {
+			prefixes, err := b.buckets.ListPrefixes(b.sharedBucket)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range prefixes {
+				if name := strings.TrimSuffix(p, "/"); validateVolumeName(name) == nil {
+					names = append(names, name)
+				}
+			}
+			continue
+		}
+		prefix, err := d.getBucketNamePrefix(backendType)
+		if err != nil {
+			return nil, err
+		}
+		buckets, err := b.buckets.ListBuckets(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucketName := range buckets {
+			if name := strings.TrimPrefix(bucketName, prefix); validateVolumeName(name) == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// discoverVolume looks up on the backends a volume created by another host,
+// from its marker object in a shared bucket or from its bucket named after the driver naming convention
+func (d *gcpVolDriver) discoverVolume(name string) (*gcsVolumes, bool, error) {
+	if validateVolumeName(name) != nil {
+		return nil, false, nil
+	}
+	for _, backendType := range d.getBackendTypes() {
+		b, err := d.getBackend(backendType)
+		if err != nil {
+			return nil, false, err
+		}
+		v := &gcsVolumes{
+			Volume: &volume.Volume{
+				Name:       name,
+				Mountpoint: d.getMountpoint(name),
+			},
+			CleanCloud: true,
+			Backend:    backendType,
+			Discovered: true,
+		}
+		if b.sharedBucket != "" {
+			marker, err := d.readVolumeMarker(b, name)
+			if err != nil {
+				if err == errObjectNotFound {
+					continue
+				}
+				return nil, false, err
+			}
+			log.Printf("Volume '%s' found in shared bucket '%s'\n", name, b.sharedBucket)
+			v.GcsBucketName = b.sharedBucket
+			v.Prefix = name
+			v.SharedBucket = true
+			v.CleanCloud = marker.Options["clean_cloud_bucket"] != "no"
+			v.Options = marker.Options
+			v.Credentials = marker.Options["credentials"]
+			v.ImpersonateServiceAccount = marker.Options["impersonate_service_account"]
+			v.Labels, _ = parseUserLabels(marker.Options)
+			v.GcsfuseOptions, _ = parseGcsfuseOptions(marker.Options)
+			v.CreatedAt = marker.CreatedAt
+			return v, true, nil
+		}
+		bucketName, err := d.getBucketName(backendType, name)
+		if err != nil {
+			continue
+		}
+		info, err := b.buckets.StatBucket(bucketName)
+		if err != nil {
+			// a bucket not accessible is not a volume of the driver
+			if err == errBucketNotFound || err == errBucketForbidden {
+				continue
+			}
+			return nil, false, err
+		}
+		log.Printf("Volume '%s' found as bucket '%s'\n", name, bucketName)
+		v.GcsBucketName = bucketName
+		v.Labels = info.Labels
+		if v.Labels == nil {
+			v.Labels = make(map[string]string)
+		}
+		v.CreatedAt = info.Created
+		return v, true, nil
+	}
+	return nil, false, nil
+}
+
+// lookupVolume returns a volume referenced by the driver, or else discovered on the backends
+func (d *gcpVolDriver) lookupVolume(name string) (*gcsVolumes, bool, error) {
+	if v, ok := d.getVolume(name); ok {
+		return v, true, nil
+	}
+	return d.discoverVolume(name)
+}
+
+// adoptVolume references on this host a volume discovered on the backends & creates its host mountpoint
+func (d *gcpVolDriver) adoptVolume(v *gcsVolumes) error {
+	m := d.getMountpoint(v.Volume.Name)
+	exist, err := d.isPathExist(m)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		if err := d.createMountpoint(m); err != nil {
+			return err
+		}
+	}
+	return d.updateVolumes(
+		func() { d.mountedBuckets[v.Volume.Name] = v },
+		func() { delete(d.mountedBuckets, v.Volume.Name) },
+	)
+}
@@ -3,59 +3,348 @@ package main
 import (
 	"fmt"
 	"log"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
-	gstorage "google.golang.org/api/storage/v1"
 )
 
 type gcpVolDriver struct {
-	gcpClient         *gstorage.BucketsService
+	// backendsMu guards backends, whose GCS backend is replaced when the GCP credentials are reloaded
+	backendsMu        sync.RWMutex
+	backends          map[string]*volumeBackend
 	gcpServiceKeyPath string
 	gcpProjectID      string
 	driverRootDir     string
-	mountedBuckets    map[string]*gcsVolumes
+	// mu guards mountedBuckets & the state file,
+	// a gcsVolumes is modified while holding both mu & the lock of its volume name
+	mu             sync.Mutex
+	mountedBuckets map[string]*gcsVolumes
+	state          *stateStore
+	volumeLocks    *volumeLocker
+	// identities are the GCS backends of the per-volume GCP identities, nil if not supported
+	identities *identityBackends
+	// remoteVolumes caches the volumes found on the backends
+	remoteVolumes *remoteVolumesCache
+	// newGcsBackend creates the GCS backend from the current GCP credentials, nil if the credentials cannot be reloaded
+	newGcsBackend func() (*volumeBackend, error)
+	// fuse supervises the gcsfuse processes, nil if the volumes are not mounted with gcsfuse
+	fuse *fuseSupervisor
+	// mountInfoPath lists the kernel mounts compared with the active mounts of the volumes
+	mountInfoPath string
+	// requestsMu guards closing & the additions to requests, the in-flight Docker requests drained on shutdown
+	requestsMu sync.Mutex
+	closing    bool
+	requests   sync.WaitGroup
 }
 
 type gcsVolumes struct {
-	volume        *volume.Volume
-	gcsBucketName string
-	cleanCloud    bool
+	Volume        *volume.Volume `json:"volume"`
+	GcsBucketName string         `json:"gcs_bucket_name"`
+	CleanCloud    bool           `json:"clean_cloud"`
+	Backend       string         `json:"backend,omitempty"`
+	// Prefix is the bucket sub-path mounted for the volume, the whole bucket is mounted if empty
+	Prefix string `json:"prefix,omitempty"`
+	// ExternalBucket is true if the bucket was not created by the driver, it is then never deleted
+	ExternalBucket bool `json:"external_bucket,omitempty"`
+	// Credentials & ImpersonateServiceAccount define the GCP identity accessing the bucket, the driver identity if empty
+	Credentials               string `json:"credentials,omitempty"`
+	ImpersonateServiceAccount string `json:"impersonate_service_account,omitempty"`
+	// SharedBucket is true if the volume is stored as a prefix of the shared bucket
+	SharedBucket bool `json:"shared_bucket,omitempty"`
+	// Discovered is true if the volume was created by another host, its bucket is never created again by this host
+	Discovered bool `json:"discovered,omitempty"`
+	// GcsfuseOptions are the validated gcsfuse flags of the volume by flag name
+	GcsfuseOptions map[string]string `json:"gcsfuse_options,omitempty"`
+	Options        map[string]string `json:"options,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	// Labels are the labels of the volume bucket, nil for the volumes created before bucket labels
+	Labels map[string]string `json:"labels"`
+	// Removing is true while the bucket of the volume is being emptied, an interrupted removal is resumed by the next Remove
+	Removing bool `json:"removing,omitempty"`
+	// Mounts references the IDs of the active mounts of the volume
+	Mounts map[string]bool `json:"mounts,omitempty"`
 }
 
-func newGcpVolDriver(driverRootDir, gcpServiceKeyPath string) (*gcpVolDriver, error) {
-	log.Printf("GCP Volume Driver creation - Driver root dir: %s\n", driverRootDir)
-	log.Printf("GCP Volume Driver creation - GCP Service Account key JSON: %s\n", gcpServiceKeyPath)
-	gcpClient, err := newGoogleStorageBucketsService(gcpServiceKeyPath)
+// addMount references an active mount ID of the volume
+func (v *gcsVolumes) addMount(mountID string) {
+	if v.Mounts == nil {
+		v.Mounts = make(map[string]bool)
+	}
+	v.Mounts[mountID] = true
+}
+
+// removeMount dereferences an active mount ID of the volume
+func (v *gcsVolumes) removeMount(mountID string) {
+	delete(v.Mounts, mountID)
+}
+
+// driverConfig gathers the settings of the volume driver
+type driverConfig struct {
+	// RootDir is the host dir holding the volume mountpoints & the driver state
+	RootDir string
+	// GcpServiceKeyPath is the GCP service key file, the Application Default Credentials are used if empty
+	GcpServiceKeyPath string
+	// GcpCredentials are the GCP service key files selected per volume by name with the option credentials
+	GcpCredentials map[string]string
+	// GcpProjectID is the GCP project of the buckets when there is no GCP service key file, from the metadata server if empty
+	GcpProjectID string
+	// GcsDefaults are the location & storage class of the GCS buckets created for the volumes
+	GcsDefaults *bucketOptions
+	// GcsRetry is the retry policy & the deadlines of the GCS calls, the defaults are used if nil
+	GcsRetry *gcsRetryPolicy
+	// GcsSharedBucket is the GCS bucket holding all the volumes as prefixes, a bucket per volume if empty
+	GcsSharedBucket string
+	// S3 enables the s3 volume backend if defined
+	S3 *s3Config
+}
+
+func newGcpVolDriver(conf *driverConfig) (*gcpVolDriver, error) {
+	log.Printf("GCP Volume Driver creation - Driver root dir: %s\n", conf.RootDir)
+	if conf.GcpServiceKeyPath != "" {
+		log.Printf("GCP Volume Driver creation - GCP Service Account key JSON: %s\n", conf.GcpServiceKeyPath)
+	} else {
+		log.Println("GCP Volume Driver creation - GCP Application Default Credentials")
+	}
+	gcpProjectID, err := resolveGCPProjectID(conf.GcpServiceKeyPath, conf.GcpProjectID)
 	if err != nil {
 		return nil, err
 	}
-	gcpProjectID, err := getGCPProjectID(gcpServiceKeyPath)
+	for name, keyPath := range conf.GcpCredentials {
+		if _, err := loadServiceAccountKey(keyPath); err != nil {
+			return nil, fmt.Errorf("Credentials %s: %s", name, err)
+		}
+	}
+	supervisor := newFuseSupervisor(filepath.Join(conf.RootDir, fuseLogsDirName))
+	newGcsVolumeBackend := func() (*volumeBackend, error) {
+		gcsBuckets, err := newGcsBackend(conf.GcpServiceKeyPath, gcpProjectID, conf.GcsDefaults, conf.GcsRetry)
+		if err != nil {
+			return nil, err
+		}
+		// fail fast rather than at the first volume creation
+		if err := gcsBuckets.checkAccess(); err != nil {
+			return nil, err
+		}
+		return &volumeBackend{
+			buckets:      gcsBuckets,
+			mounter:      newGcsfuseMounter(conf.GcpServiceKeyPath, supervisor),
+			bucketPrefix: gcpProjectID,
+			sharedBucket: conf.GcsSharedBucket,
+		}, nil
+	}
+	gcsVolumeBackend, err := newGcsVolumeBackend()
 	if err != nil {
 		return nil, err
 	}
+	backends := map[string]*volumeBackend{
+		backendGCS: gcsVolumeBackend,
+	}
+	if conf.S3 != nil {
+		s3Buckets, err := newS3Backend(conf.S3)
+		if err != nil {
+			return nil, err
+		}
+		s3Mounter, err := newS3Mounter(conf.S3)
+		if err != nil {
+			return nil, err
+		}
+		backends[backendS3] = &volumeBackend{
+			buckets:      s3Buckets,
+			mounter:      s3Mounter,
+			bucketPrefix: conf.S3.BucketPrefix,
+		}
+	}
+	for name, keyPath := range conf.GcpCredentials {
+		log.Printf("GCP Volume Driver creation - GCP credentials '%s': %s\n", name, keyPath)
+	}
+	identities := newIdentityBackends(conf.GcpCredentials, func(id volumeIdentity) (*volumeBackend, error) {
+		keyPath := conf.GcpServiceKeyPath
+		if id.Credentials != "" {
+			keyPath = conf.GcpCredentials[id.Credentials]
+		}
+		tokenSource, err := newGoogleTokenSource(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		mounterKeyPath := keyPath
+		if id.ImpersonateServiceAccount != "" {
+			tokenSource = newImpersonatedTokenSource(tokenSource, id.ImpersonateServiceAccount)
+			mounterKeyPath, err = writeImpersonationKeyFile(conf.RootDir, keyPath, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buckets, err := newGcsBackendWithTokenSource(tokenSource, gcpProjectID, conf.GcsDefaults, conf.GcsRetry)
+		if err != nil {
+			return nil, err
+		}
+		return &volumeBackend{
+			buckets:      buckets,
+			mounter:      newGcsfuseMounter(mounterKeyPath, supervisor),
+			bucketPrefix: gcpProjectID,
+			sharedBucket: conf.GcsSharedBucket,
+		}, nil
+	})
+	d, err := newVolDriver(conf.RootDir, conf.GcpServiceKeyPath, gcpProjectID, backends, identities, supervisor, selfMountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	d.newGcsBackend = newGcsVolumeBackend
+	return d, nil
+}
+
+// newVolDriver creates a volume driver on top of the backends of each backend type, loads its existing volumes
+// & reconciles their active mounts with the kernel mounts listed by mountInfoPath;
+// identities may be nil if the per-volume GCP identities are not supported, fuse if gcsfuse is not used
+func newVolDriver(driverRootDir, gcpServiceKeyPath, gcpProjectID string, backends map[string]*volumeBackend, identities *identityBackends, fuse *fuseSupervisor, mountInfoPath string) (*gcpVolDriver, error) {
 	d := &gcpVolDriver{
-		gcpClient:         gcpClient,
+		identities:        identities,
+		backends:          backends,
 		gcpServiceKeyPath: gcpServiceKeyPath,
 		gcpProjectID:      gcpProjectID,
 		driverRootDir:     driverRootDir,
 		mountedBuckets:    make(map[string]*gcsVolumes),
+		state:             newStateStore(driverRootDir),
+		volumeLocks:       newVolumeLocker(),
+		remoteVolumes:     &remoteVolumesCache{ttl: remoteVolumesTTL},
+		fuse:              fuse,
+		mountInfoPath:     mountInfoPath,
 	}
-	if err := d.syncWithHost(); err != nil {
+	for _, b := range backends {
+		if b.sharedBucket == "" {
+			continue
+		}
+		exist, err := b.buckets.BucketExists(b.sharedBucket)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			return nil, fmt.Errorf("Shared bucket %s does not exist", b.sharedBucket)
+		}
+		log.Printf("Volumes are stored as prefixes of the shared bucket '%s'\n", b.sharedBucket)
+	}
+	if err := d.loadState(); err != nil {
 		return nil, err
 	}
+	d.reconcileMounts()
 	return d, nil
 }
 
+// lockVolume serializes the requests on a volume name & returns the function unlocking it
+func (d *gcpVolDriver) lockVolume(name string) func() {
+	return d.volumeLocks.lock(name)
+}
+
+// getVolume returns a volume referenced by the driver
+func (d *gcpVolDriver) getVolume(name string) (*gcsVolumes, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.mountedBuckets[name]
+	return v, ok
+}
+
+// updateVolumes applies a change on the driver volumes & persists it,
+// the change is reverted if the state cannot be saved
+func (d *gcpVolDriver) updateVolumes(apply func(), revert func()) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	apply()
+	if err := d.state.save(d.mountedBuckets); err != nil {
+		revert()
+		return err
+	}
+	return nil
+}
+
 func (d *gcpVolDriver) Create(r volume.Request) volume.Response {
 	log.Printf("Creation of volume '%s'...\n", r.Name)
+	if err := validateVolumeName(r.Name); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	unlock := d.lockVolume(r.Name)
+	defer unlock()
+	if _, ok := d.getVolume(r.Name); ok {
+		return volume.Response{Err: fmt.Sprintf("Volume %s already exists", r.Name)}
+	}
+	// Select the volume backend
+	backendType := backendGCS
+	if val, ok := r.Options["backend"]; ok {
+		backendType = val
+	}
+	if _, err := d.getBackend(backendType); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Select the GCP identity accessing the bucket
+	id, err := d.parseVolumeIdentity(backendType, r.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	b, err := d.getVolumeBackend(backendType, id)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Validate the bucket location & storage class
+	bucketOpts, err := parseBucketOptions(backendType, r.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Validate the user labels of the bucket
+	userLabels, err := parseUserLabels(r.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Validate the gcsfuse options
+	fuseOpts, err := parseGcsfuseOptions(r.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if fuseOpts != nil && backendType != backendGCS {
+		return volume.Response{Err: "The gcsfuse options are only supported by the gcs backend"}
+	}
+	// Validate the mounted bucket sub-path
+	prefix, err := parseBucketPrefix(r.Options["prefix"])
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Store the volume as a prefix of the shared bucket unless a bucket is attached
+	shared := b.sharedBucket != "" && r.Options["bucket"] == ""
+	if shared {
+		if prefix != "" {
+			return volume.Response{Err: "The prefix option is not supported for volumes stored in the shared bucket"}
+		}
+		// the volume may already exist in the shared bucket, created by another host
+		discovered, ok, err := d.discoverVolume(r.Name)
+		if err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		if ok {
+			if err := d.adoptVolume(discovered); err != nil {
+				return volume.Response{Err: err.Error()}
+			}
+			return volume.Response{}
+		}
+		prefix = r.Name
+	}
 	// Create a host mountpoint
 	m, err := d.handleCreateMountpoint(r.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
-	// Create a bucket on GCP Storage
-	bucketName, err := d.handleCreateGCStorageBucket(r.Name)
+	// Attach an existing bucket or create a bucket on the backend
+	bucketName := r.Options["bucket"]
+	attached := bucketName != "" && !shared
+	labels := userLabels
+	switch {
+	case shared:
+		bucketName = b.sharedBucket
+	case attached:
+		labels, err = d.handleAttachBucket(backendType, id, bucketName, bucketOpts)
+	default:
+		bucketName, labels, err = d.handleCreateBucket(backendType, id, r.Name, bucketOpts, userLabels)
+	}
 	if err != nil {
+		d.handleDeleteMountpoint(r.Name)
 		return volume.Response{Err: err.Error()}
 	}
 	// Refer volumeName <-> gcsVolumes
@@ -64,30 +353,89 @@ func (d *gcpVolDriver) Create(r volume.Request) volume.Response {
 	if ok && val == "no" {
 		cleanCloud = false
 	}
-	d.mountedBuckets[r.Name] = &gcsVolumes{
-		volume: &volume.Volume{
+	v := &gcsVolumes{
+		Volume: &volume.Volume{
 			Name:       r.Name,
 			Mountpoint: m,
 		},
-		gcsBucketName: bucketName,
-		cleanCloud:    cleanCloud,
+		GcsBucketName:             bucketName,
+		CleanCloud:                cleanCloud,
+		Backend:                   backendType,
+		Prefix:                    prefix,
+		ExternalBucket:            attached,
+		SharedBucket:              shared,
+		GcsfuseOptions:            fuseOpts,
+		Credentials:               id.Credentials,
+		ImpersonateServiceAccount: id.ImpersonateServiceAccount,
+		Options:                   r.Options,
+		Labels:                    labels,
+		CreatedAt:                 time.Now().UTC(),
+	}
+	// Mark the volume prefix in the shared bucket
+	if shared {
+		if err := d.writeVolumeMarker(b, v); err != nil {
+			d.handleDeleteMountpoint(r.Name)
+			return volume.Response{Err: err.Error()}
+		}
+	}
+	// Persist the new volume
+	if err := d.updateVolumes(
+		func() { d.mountedBuckets[r.Name] = v },
+		func() { delete(d.mountedBuckets, r.Name) },
+	); err != nil {
+		d.handleDeleteMountpoint(r.Name)
+		return volume.Response{Err: err.Error()}
 	}
 	return volume.Response{}
 }
 
 func (d *gcpVolDriver) Remove(r volume.Request) volume.Response {
 	log.Printf("Remove volume '%s'\n", r.Name)
-	// Delete host mountpoint if necessary
-	err := d.handleDeleteMountpoint(r.Name)
+	unlock := d.lockVolume(r.Name)
+	defer unlock()
+	v, ok, err := d.lookupVolume(r.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
-	// Empty & Delete Google Cloud Storage bucket if necessary
-	if err := d.handleRemoveGCStorageBucket(r.Name); err != nil {
+	if !ok {
+		return volume.Response{Err: fmt.Sprintf("Volume %s not found", r.Name)}
+	}
+	// Refuse to remove a volume still mounted, only the mounts of this host are known:
+	// with the global scope, the volume must not be used by any other host when it is removed
+	if len(v.Mounts) > 0 {
+		return volume.Response{Err: fmt.Sprintf("Volume %s is in use by %d mount(s)", r.Name, len(v.Mounts))}
+	}
+	// Delete host mountpoint if necessary
+	if err := d.handleDeleteMountpoint(r.Name); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Mark the volume as being removed until its bucket is emptied
+	if v.Removing {
+		log.Printf("Resuming the interrupted removal of volume '%s'\n", r.Name)
+	} else if _, known := d.getVolume(r.Name); known {
+		if err := d.updateVolumes(
+			func() { v.Removing = true },
+			func() { v.Removing = false },
+		); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+	}
+	// Empty & Delete the backend bucket if necessary
+	if err := d.handleRemoveBucket(v); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// Remove the volume from the internal map & persist it
+	if err := d.updateVolumes(
+		func() { delete(d.mountedBuckets, r.Name) },
+		func() { d.mountedBuckets[r.Name] = v },
+	); err != nil {
 		return volume.Response{Err: err.Error()}
 	}
-	// Remove the volume from the internal map
-	delete(d.mountedBuckets, r.Name)
+	d.remoteVolumes.invalidate()
+	// Remove the gcsfuse logs of the volume
+	if d.fuse != nil {
+		d.fuse.removeLogs(r.Name)
+	}
 	return volume.Response{}
 }
 
@@ -98,46 +446,116 @@ func (d *gcpVolDriver) Path(r volume.Request) volume.Response {
 }
 
 func (d *gcpVolDriver) List(r volume.Request) volume.Response {
+	// volumes found on the backends, which may have been created by other hosts
+	remoteNames, err := d.listRemoteVolumes()
+	if err != nil {
+		log.Printf("Listing the volumes of the backends failed: %s\n", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	var volumes []*volume.Volume
 	for _, v := range d.mountedBuckets {
-		volumes = append(volumes, v.volume)
+		volumes = append(volumes, v.Volume)
+	}
+	for _, name := range remoteNames {
+		if _, ok := d.mountedBuckets[name]; !ok {
+			volumes = append(volumes, &volume.Volume{
+				Name:       name,
+				Mountpoint: d.getMountpoint(name),
+			})
+		}
 	}
 	return volume.Response{Volumes: volumes}
 }
 
 func (d *gcpVolDriver) Get(r volume.Request) volume.Response {
-	mountedBucked, ok := d.mountedBuckets[r.Name]
+	mountedBucked, ok, err := d.lookupVolume(r.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
 	if ok {
 		return volume.Response{
-			Volume: mountedBucked.volume,
+			Volume: mountedBucked.Volume,
 		}
 	}
 	return volume.Response{}
 }
 
 func (d *gcpVolDriver) Mount(r volume.Request) volume.Response {
-	log.Printf("Mount volume '%s'\n", r.Name)
+	log.Printf("Mount volume '%s' (mount ID '%s')\n", r.Name, r.MountID)
+	unlock := d.lockVolume(r.Name)
+	defer unlock()
+	v, ok := d.getVolume(r.Name)
+	if !ok {
+		// reference the volume on this host if it was created by another host
+		discovered, found, err := d.discoverVolume(r.Name)
+		if err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		if !found {
+			return volume.Response{Err: fmt.Sprintf("Volume %s not found", r.Name)}
+		}
+		if err := d.adoptVolume(discovered); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		v = discovered
+	}
+	if v.Removing {
+		return volume.Response{Err: fmt.Sprintf("Volume %s is partially removed, remove it again", r.Name)}
+	}
 	// get mountpoint
 	m := d.getMountpoint(r.Name)
-	// mountpoint exists?
+	// create the mountpoint lazily if it does not exist on this host
 	exist, err := d.isPathExist(m)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 	if !exist {
-		return volume.Response{Err: fmt.Sprintf("Host mountpoint %s does not exist", m)}
+		if err := d.createMountpoint(m); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+	}
+	// already mounted for this mount ID?
+	if v.Mounts[r.MountID] {
+		log.Printf("Volume '%s' already mounted for mount ID '%s'\n", r.Name, r.MountID)
+		return volume.Response{Mountpoint: m}
 	}
-	// mount a GC Storage bucket using gcsfuse on the host mountpoint
-	if err := d.mountGcsfuse(r.Name); err != nil {
+	b, err := d.getVolumeBackend(v.backendType(), v.identity())
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// mount the bucket on the host mountpoint only for the first active mount
+	first := len(v.Mounts) == 0
+	if first {
+		if err := b.mounter.Mount(v, m); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+	} else {
+		log.Printf("Volume '%s' already mounted, %d active mount(s)\n", r.Name, len(v.Mounts))
+	}
+	// reference & persist the active mount
+	if err := d.updateVolumes(
+		func() { v.addMount(r.MountID) },
+		func() { v.removeMount(r.MountID) },
+	); err != nil {
+		if first {
+			b.mounter.Unmount(m)
+		}
 		return volume.Response{Err: err.Error()}
 	}
 	return volume.Response{
-		Mountpoint: d.getMountpoint(r.Name),
+		Mountpoint: m,
 	}
 }
 
 func (d *gcpVolDriver) Unmount(r volume.Request) volume.Response {
-	log.Printf("Unmount volume '%s'\n", r.Name)
+	log.Printf("Unmount volume '%s' (mount ID '%s')\n", r.Name, r.MountID)
+	unlock := d.lockVolume(r.Name)
+	defer unlock()
+	v, ok := d.getVolume(r.Name)
+	if !ok {
+		return volume.Response{Err: fmt.Sprintf("Volume %s not found", r.Name)}
+	}
 	// get mountpoint
 	m := d.getMountpoint(r.Name)
 	// mountpoint exists?
@@ -148,8 +566,27 @@ func (d *gcpVolDriver) Unmount(r volume.Request) volume.Response {
 	if !exist {
 		return volume.Response{Err: fmt.Sprintf("Host mountpoint %s does not exist", m)}
 	}
-	// unmount the GC Storage bucket
-	if err := d.unmountGcsfuse(r.Name); err != nil {
+	if !v.Mounts[r.MountID] {
+		log.Printf("Volume '%s' has no active mount for mount ID '%s'\n", r.Name, r.MountID)
+		return volume.Response{}
+	}
+	b, err := d.getVolumeBackend(v.backendType(), v.identity())
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	// unmount the bucket only after the last active mount
+	if len(v.Mounts) == 1 {
+		if err := b.mounter.Unmount(m); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+	} else {
+		log.Printf("Volume '%s' still in use, %d active mount(s) left\n", r.Name, len(v.Mounts)-1)
+	}
+	// dereference & persist the active mount
+	if err := d.updateVolumes(
+		func() { v.removeMount(r.MountID) },
+		func() { v.addMount(r.MountID) },
+	); err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 	return volume.Response{}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// testProjectID is the GCP project of the test drivers, prefixing the names of their buckets
+const testProjectID = "test-project"
+
+// newTestDriver creates a driver storing its buckets in memory & mounting them as plain dirs, in a temporary root dir
+func newTestDriver(t *testing.T) (*gcpVolDriver, *memoryBackend, *dirMounter) {
+	t.Helper()
+	buckets := newMemoryBackend()
+	mounter := newDirMounter()
+	return newTestDriverWith(t, t.TempDir(), buckets, mounter), buckets, mounter
+}
+
+// newTestDriverWith creates a driver on top of a root dir, an object storage & a mounter, without any kernel mount
+func newTestDriverWith(t *testing.T, rootDir string, buckets BucketBackend, mounter Mounter) *gcpVolDriver {
+	t.Helper()
+	d, err := newVolDriver(rootDir, "", testProjectID, map[string]*volumeBackend{
+		backendGCS: {
+			buckets:      buckets,
+			mounter:      mounter,
+			bucketPrefix: testProjectID,
+		},
+	}, nil, nil, writeTestMountInfo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// testClient sends the Docker volume plugin requests to a driver served over HTTP
+type testClient struct {
+	t    *testing.T
+	base string
+}
+
+// serveTestDriver serves the HTTP handler of a driver on a local TCP port until the end of the test
+func serveTestDriver(t *testing.T, d *gcpVolDriver) *testClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go newVolumeHandler(d).Serve(l)
+	return &testClient{t: t, base: "http://" + l.Addr().String()}
+}
+
+// call sends a request to a plugin API endpoint & decodes its response
+func (c *testClient) call(endpoint string, req volume.Request) volume.Response {
+	body, err := json.Marshal(&req)
+	if err != nil {
+		c.t.Error(err)
+		return volume.Response{}
+	}
+	resp, err := http.Post(c.base+"/VolumeDriver."+endpoint, "application/vnd.docker.plugins.v1.1+json", bytes.NewReader(body))
+	if err != nil {
+		c.t.Error(err)
+		return volume.Response{}
+	}
+	defer resp.Body.Close()
+	var res volume.Response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		c.t.Errorf("%s %s: %s", endpoint, req.Name, err)
+	}
+	return res
+}
+
+// mustCall sends a request which must succeed, it can be called from any goroutine
+func (c *testClient) mustCall(endpoint string, req volume.Request) volume.Response {
+	res := c.call(endpoint, req)
+	if res.Err != "" {
+		c.t.Errorf("%s %s: %s", endpoint, req.Name, res.Err)
+	}
+	return res
+}
+
+// checkVolumeConsistency checks that a volume is either fully created or fully removed:
+// referenced by the driver & persisted, with its host mountpoint & its bucket
+func checkVolumeConsistency(t *testing.T, d *gcpVolDriver, buckets *memoryBackend, name string) {
+	t.Helper()
+	_, referenced := d.getVolume(name)
+	persisted, err := d.state.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inState := persisted[name]
+	mountpoint, err := d.isPathExist(d.getMountpoint(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, _ := buckets.BucketExists(d.getGCPBucketName(name))
+	if referenced != inState || referenced != mountpoint || referenced != bucket {
+		t.Errorf("volume %s is inconsistent: referenced %t, persisted %t, mountpoint %t, bucket %t", name, referenced, inState, mountpoint, bucket)
+	}
+}
+
+func TestConcurrentCreateRemoveSameName(t *testing.T) {
+	d, buckets, _ := newTestDriver(t)
+	c := serveTestDriver(t, d)
+	const workers, rounds = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				// the requests fail with "already exists" or "not found" when another worker wins the race
+				c.call("Create", volume.Request{Name: "shared"})
+				c.call("Get", volume.Request{Name: "shared"})
+				c.call("List", volume.Request{})
+				c.call("Remove", volume.Request{Name: "shared"})
+			}
+		}()
+	}
+	wg.Wait()
+	checkVolumeConsistency(t, d, buckets, "shared")
+
+	c.mustCall("Create", volume.Request{Name: "shared"})
+	checkVolumeConsistency(t, d, buckets, "shared")
+	if res := c.call("Create", volume.Request{Name: "shared"}); res.Err == "" {
+		t.Error("creating an existing volume succeeded")
+	}
+	c.mustCall("Remove", volume.Request{Name: "shared"})
+	checkVolumeConsistency(t, d, buckets, "shared")
+}
+
+func TestParallelMountUnmountDifferentVolumes(t *testing.T) {
+	d, buckets, mounter := newTestDriver(t)
+	c := serveTestDriver(t, d)
+	const volumes, mountsPerVolume = 8, 4
+	for i := 0; i < volumes; i++ {
+		c.mustCall("Create", volume.Request{Name: fmt.Sprintf("vol%d", i)})
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < volumes; i++ {
+		for j := 0; j < mountsPerVolume; j++ {
+			wg.Add(1)
+			go func(name, mountID string) {
+				defer wg.Done()
+				for k := 0; k < 10; k++ {
+					res := c.mustCall("Mount", volume.Request{Name: name, MountID: mountID})
+					if res.Mountpoint != d.getMountpoint(name) {
+						t.Errorf("volume %s mounted on %s, not %s", name, res.Mountpoint, d.getMountpoint(name))
+					}
+					if !mounter.isMounted(d.getMountpoint(name)) {
+						t.Errorf("volume %s has an active mount but is not mounted", name)
+					}
+					c.call("Get", volume.Request{Name: name})
+					c.mustCall("Unmount", volume.Request{Name: name, MountID: mountID})
+				}
+			}(fmt.Sprintf("vol%d", i), fmt.Sprintf("container%d", j))
+		}
+	}
+	wg.Wait()
+	persisted, err := d.state.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < volumes; i++ {
+		name := fmt.Sprintf("vol%d", i)
+		v, _ := d.getVolume(name)
+		if len(v.Mounts) != 0 || len(persisted[name].Mounts) != 0 {
+			t.Errorf("volume %s has active mounts left: %v, persisted %v", name, v.Mounts, persisted[name].Mounts)
+		}
+		if mounter.isMounted(d.getMountpoint(name)) {
+			t.Errorf("volume %s is still mounted", name)
+		}
+		c.mustCall("Remove", volume.Request{Name: name})
+		checkVolumeConsistency(t, d, buckets, name)
+	}
+	if entries, _ := ioutil.ReadDir(d.driverRootDir); len(entries) != 1 || entries[0].Name() != stateFileName {
+		t.Errorf("the driver root dir is not empty after the removal of the volumes: %d entries", len(entries))
+	}
+}
+
+// breakStateStore makes the saves of the driver state fail until the returned function restores it
+func breakStateStore(t *testing.T, d *gcpVolDriver) func() {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := d.state
+	// the state dir cannot be created under a regular file
+	d.state = newStateStore(file)
+	return func() { d.state = state }
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	d, buckets, mounter := newTestDriver(t)
+	bucketName := d.getGCPBucketName("data")
+	if res := d.Create(volume.Request{Name: "data", Options: map[string]string{"label.team": "infra"}}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+	info, err := buckets.StatBucket(bucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDriverOwned(info.Labels) || info.Labels["team"] != "infra" || info.Labels[labelVolume] != "data" {
+		t.Errorf("bucket %s has the labels %v", bucketName, info.Labels)
+	}
+
+	res := d.Mount(volume.Request{Name: "data", MountID: "c1"})
+	if res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if res.Mountpoint != d.getMountpoint("data") || !mounter.isMounted(res.Mountpoint) {
+		t.Fatalf("volume mounted on %s, mounted %t", res.Mountpoint, mounter.isMounted(res.Mountpoint))
+	}
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err == "" {
+		t.Fatal("removing a mounted volume succeeded")
+	}
+	if res := d.Unmount(volume.Request{Name: "data", MountID: "c1"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if mounter.isMounted(d.getMountpoint("data")) {
+		t.Fatal("volume still mounted after its last unmount")
+	}
+
+	// the objects written through the mount are deleted with the bucket
+	for i := 0; i < memoryPageSize+10; i++ {
+		buckets.PutObject(bucketName, fmt.Sprintf("dir/file%d", i), []byte("data"))
+	}
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+	if res := d.Get(volume.Request{Name: "data"}); res.Volume != nil {
+		t.Errorf("removed volume still returned: %v", res.Volume)
+	}
+}
+
+func TestRemoveKeepsBuckets(t *testing.T) {
+	d, buckets, _ := newTestDriver(t)
+	if err := buckets.CreateBucket("external", &bucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if res := d.Create(volume.Request{Name: "kept", Options: map[string]string{"clean_cloud_bucket": "no"}}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if res := d.Create(volume.Request{Name: "attached", Options: map[string]string{"bucket": "external"}}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	buckets.PutObject(d.getGCPBucketName("kept"), "file", []byte("data"))
+	buckets.PutObject("external", "file", []byte("data"))
+	for _, name := range []string{"kept", "attached"} {
+		if res := d.Remove(volume.Request{Name: name}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+		if _, ok := d.getVolume(name); ok {
+			t.Errorf("volume %s still referenced after its removal", name)
+		}
+	}
+	for _, bucketName := range []string{d.getGCPBucketName("kept"), "external"} {
+		if _, err := buckets.GetObject(bucketName, "file"); err != nil {
+			t.Errorf("bucket %s deleted or emptied: %s", bucketName, err)
+		}
+	}
+}
+
+func TestCreateRollbackOnStateSaveFailure(t *testing.T) {
+	d, buckets, _ := newTestDriver(t)
+	restore := breakStateStore(t, d)
+	if res := d.Create(volume.Request{Name: "data"}); res.Err == "" {
+		t.Fatal("creating a volume succeeded without saving the state")
+	}
+	if _, ok := d.getVolume("data"); ok {
+		t.Error("volume referenced without being persisted")
+	}
+	if exist, _ := d.isPathExist(d.getMountpoint("data")); exist {
+		t.Error("host mountpoint left behind")
+	}
+	// the bucket created before the failure is reused by the next creation
+	restore()
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+}
+
+func TestRemoveRollbackOnStateSaveFailure(t *testing.T) {
+	d, buckets, _ := newTestDriver(t)
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	restore := breakStateStore(t, d)
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err == "" {
+		t.Fatal("removing a volume succeeded without saving the state")
+	}
+	v, ok := d.getVolume("data")
+	if !ok || v.Removing {
+		t.Fatalf("volume referenced %t after a failed removal", ok)
+	}
+	if exist, _ := buckets.BucketExists(d.getGCPBucketName("data")); !exist {
+		t.Error("bucket deleted without persisting the removal")
+	}
+	restore()
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+}
+
+func TestRemoveResumesInterruptedRemoval(t *testing.T) {
+	d, buckets, _ := newTestDriver(t)
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	// an object which cannot be deleted interrupts the emptying of the bucket
+	buckets.PutObject(d.getGCPBucketName("data"), "file", []byte("data"))
+	failing := &failingBuckets{memoryBackend: buckets, deleteErr: fmt.Errorf("network error")}
+	d.backends[backendGCS].buckets = failing
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err == "" {
+		t.Fatal("removing a volume succeeded without emptying its bucket")
+	}
+	if v, _ := d.getVolume("data"); !v.Removing {
+		t.Fatal("interrupted removal not persisted")
+	}
+	if res := d.Mount(volume.Request{Name: "data", MountID: "c1"}); res.Err == "" {
+		t.Error("mounting a partially removed volume succeeded")
+	}
+	failing.deleteErr = nil
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+}
+
+// failingBuckets is a memoryBackend whose object deletions fail with deleteErr if defined
+type failingBuckets struct {
+	*memoryBackend
+	deleteErr error
+}
+
+func (b *failingBuckets) DeleteObjectVersion(bucketName string, o objectVersion) error {
+	if b.deleteErr != nil {
+		return b.deleteErr
+	}
+	return b.memoryBackend.DeleteObjectVersion(bucketName, o)
+}
+
+// failingMounter is a dirMounter whose mounts & unmounts fail with mountErr & unmountErr if defined
+type failingMounter struct {
+	*dirMounter
+	mountErr   error
+	unmountErr error
+}
+
+func (m *failingMounter) Mount(v *gcsVolumes, mountpoint string) error {
+	if m.mountErr != nil {
+		return m.mountErr
+	}
+	return m.dirMounter.Mount(v, mountpoint)
+}
+
+func (m *failingMounter) Unmount(mountpoint string) error {
+	if m.unmountErr != nil {
+		return m.unmountErr
+	}
+	return m.dirMounter.Unmount(mountpoint)
+}
+
+// checkActiveMounts checks the active mount IDs of a volume, referenced & persisted
+func checkActiveMounts(t *testing.T, d *gcpVolDriver, name string, mountIDs ...string) {
+	t.Helper()
+	persisted, err := d.state.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := d.getVolume(name)
+	if len(v.Mounts) != len(mountIDs) || len(persisted[name].Mounts) != len(mountIDs) {
+		t.Fatalf("volume %s has the active mounts %v, persisted %v, expected %v", name, v.Mounts, persisted[name].Mounts, mountIDs)
+	}
+	for _, id := range mountIDs {
+		if !v.Mounts[id] || !persisted[name].Mounts[id] {
+			t.Errorf("volume %s has no active mount %s", name, id)
+		}
+	}
+}
+
+func TestMountFailure(t *testing.T) {
+	mounter := &failingMounter{dirMounter: newDirMounter(), mountErr: fmt.Errorf("mount failed")}
+	d := newTestDriverWith(t, t.TempDir(), newMemoryBackend(), mounter)
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if res := d.Mount(volume.Request{Name: "data", MountID: "c1"}); res.Err != "mount failed" {
+		t.Fatalf("mount error %q", res.Err)
+	}
+	checkActiveMounts(t, d, "data")
+	mounter.mountErr = nil
+	if res := d.Mount(volume.Request{Name: "data", MountID: "c1"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkActiveMounts(t, d, "data", "c1")
+}
+
+func TestMountRollbackOnStateSaveFailure(t *testing.T) {
+	d, _, mounter := newTestDriver(t)
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	restore := breakStateStore(t, d)
+	if res := d.Mount(volume.Request{Name: "data", MountID: "c1"}); res.Err == "" {
+		t.Fatal("mounting a volume succeeded without saving the state")
+	}
+	if mounter.isMounted(d.getMountpoint("data")) {
+		t.Error("volume left mounted without any active mount")
+	}
+	restore()
+	checkActiveMounts(t, d, "data")
+}
+
+func TestUnmountFailureKeepsMount(t *testing.T) {
+	mounter := &failingMounter{dirMounter: newDirMounter()}
+	d := newTestDriverWith(t, t.TempDir(), newMemoryBackend(), mounter)
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if res := d.Mount(volume.Request{Name: "data", MountID: id}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	// the bucket is only unmounted after the last active mount
+	mounter.unmountErr = fmt.Errorf("device busy")
+	if res := d.Unmount(volume.Request{Name: "data", MountID: "c1"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if res := d.Unmount(volume.Request{Name: "data", MountID: "c2"}); res.Err != "device busy" {
+		t.Fatalf("unmount error %q", res.Err)
+	}
+	checkActiveMounts(t, d, "data", "c2")
+	if !mounter.isMounted(d.getMountpoint("data")) {
+		t.Error("volume unmounted")
+	}
+	mounter.unmountErr = nil
+	if res := d.Unmount(volume.Request{Name: "data", MountID: "c2"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkActiveMounts(t, d, "data")
+}
+
+func TestRestartRecovery(t *testing.T) {
+	rootDir := t.TempDir()
+	buckets := newMemoryBackend()
+	// the mounts of the host outlive the driver process
+	mounter := newDirMounter()
+	d := newTestDriverWith(t, rootDir, buckets, mounter)
+	for _, name := range []string{"mounted", "idle"} {
+		if res := d.Create(volume.Request{Name: name}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	if res := d.Mount(volume.Request{Name: "mounted", MountID: "c1"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	// the mountpoint & the bucket of a volume disappeared while the driver was down
+	if err := d.handleDeleteMountpoint("idle"); err != nil {
+		t.Fatal(err)
+	}
+	if err := buckets.DeleteBucket(d.getGCPBucketName("idle")); err != nil {
+		t.Fatal(err)
+	}
+
+	d = newTestDriverWith(t, rootDir, buckets, mounter)
+	checkVolumeConsistency(t, d, buckets, "idle")
+	checkVolumeConsistency(t, d, buckets, "mounted")
+	checkActiveMounts(t, d, "mounted", "c1")
+	// the volume is already mounted for its other containers
+	if res := d.Mount(volume.Request{Name: "mounted", MountID: "c2"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if res := d.Unmount(volume.Request{Name: "mounted", MountID: id}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	if mounter.isMounted(d.getMountpoint("mounted")) {
+		t.Error("volume still mounted after its last unmount")
+	}
+	if res := d.List(volume.Request{}); len(res.Volumes) != 2 {
+		t.Errorf("%d volume(s) listed after the restart", len(res.Volumes))
+	}
+}
+
+func TestUpgradeFromHostVolumes(t *testing.T) {
+	// a volume dir & its bucket left by a driver version without state file nor ownership labels
+	rootDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootDir, "data", "_data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	buckets := newMemoryBackend()
+	bucketName := testProjectID + "_data"
+	if err := buckets.CreateBucket(bucketName, &bucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	buckets.PutObject(bucketName, "file", []byte("data"))
+
+	d := newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	v, ok := d.getVolume("data")
+	if !ok || v.GcsBucketName != bucketName || !isDriverOwned(v.Labels) {
+		t.Fatalf("volume of the host dir loaded %t: %+v", ok, v)
+	}
+	if info, err := buckets.StatBucket(bucketName); err != nil || !isDriverOwned(info.Labels) {
+		t.Errorf("bucket of the host dir labeled %v: %v", info, err)
+	}
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if exist, _ := buckets.BucketExists(bucketName); exist {
+		t.Error("bucket of the host dir kept on removal")
+	}
+}
+
+func TestRestartDropsVolumesRemovedByAnotherHost(t *testing.T) {
+	// two hosts sharing the same object storage
+	buckets := newMemoryBackend()
+	hostA := newTestDriverWith(t, t.TempDir(), buckets, newDirMounter())
+	rootB := t.TempDir()
+	hostB := newTestDriverWith(t, rootB, buckets, newDirMounter())
+	for _, name := range []string{"removed", "kept", "mounted"} {
+		if res := hostA.Create(volume.Request{Name: name}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+		// the volume of host A is referenced by host B on its first mount
+		if res := hostB.Mount(volume.Request{Name: name, MountID: "b1"}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+		if name != "mounted" {
+			if res := hostB.Unmount(volume.Request{Name: name, MountID: "b1"}); res.Err != "" {
+				t.Fatal(res.Err)
+			}
+		}
+	}
+	for _, name := range []string{"removed", "mounted"} {
+		if res := hostA.Remove(volume.Request{Name: name}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+
+	hostB = newTestDriverWith(t, rootB, buckets, newDirMounter())
+	if exist, _ := buckets.BucketExists(hostB.getGCPBucketName("removed")); exist {
+		t.Error("bucket of a volume removed by another host created again")
+	}
+	checkVolumeConsistency(t, hostB, buckets, "removed")
+	checkVolumeConsistency(t, hostB, buckets, "kept")
+	// a volume in use by a container of host B is kept without creating its bucket again
+	if _, ok := hostB.getVolume("mounted"); !ok {
+		t.Error("mounted volume dropped")
+	}
+	if exist, _ := buckets.BucketExists(hostB.getGCPBucketName("mounted")); exist {
+		t.Error("bucket of a mounted volume removed by another host created again")
+	}
+}
+
+func TestRestartKeepsInterruptedRemoval(t *testing.T) {
+	rootDir := t.TempDir()
+	buckets := newMemoryBackend()
+	d := newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	// the driver crashed after the deletion of the bucket, before persisting the removal
+	if err := d.updateVolumes(
+		func() { d.mountedBuckets["data"].Removing = true },
+		func() {},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := buckets.DeleteBucket(d.getGCPBucketName("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	d = newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	if exist, _ := buckets.BucketExists(d.getGCPBucketName("data")); exist {
+		t.Error("bucket of a partially removed volume created again")
+	}
+	if res := d.Mount(volume.Request{Name: "data", MountID: "c1"}); res.Err == "" {
+		t.Error("mounting a partially removed volume succeeded")
+	}
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	checkVolumeConsistency(t, d, buckets, "data")
+}
+
+func TestShutdownUnmountKeepsVolumesInUse(t *testing.T) {
+	d, _, mounter := newTestDriver(t)
+	for _, name := range []string{"used", "idle"} {
+		if res := d.Create(volume.Request{Name: name}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	if res := d.Mount(volume.Request{Name: "used", MountID: "c1"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	d.shutdown(time.Second, true)
+	if !mounter.isMounted(d.getMountpoint("used")) {
+		t.Errorf("volume in use unmounted by the shutdown")
+	}
+	checkActiveMounts(t, d, "used", "c1")
+	if d.beginRequest() {
+		t.Errorf("request accepted after the shutdown")
+	}
+}
+
+// newSharedBucketTestDriver creates a driver storing its volumes as prefixes of the shared bucket of an object storage
+func newSharedBucketTestDriver(t *testing.T, buckets BucketBackend, sharedBucket string) (*gcpVolDriver, error) {
+	t.Helper()
+	return newVolDriver(t.TempDir(), "", testProjectID, map[string]*volumeBackend{
+		backendGCS: {
+			buckets:      buckets,
+			mounter:      newDirMounter(),
+			bucketPrefix: testProjectID,
+			sharedBucket: sharedBucket,
+		},
+	}, nil, nil, writeTestMountInfo(t))
+}
+
+func TestSharedBucketLifecycle(t *testing.T) {
+	buckets := newMemoryBackend()
+	if _, err := newSharedBucketTestDriver(t, buckets, "shared"); err == nil {
+		t.Fatal("driver created without its shared bucket")
+	}
+	if err := buckets.CreateBucket("shared", &bucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// two hosts sharing the same bucket
+	hostA, err := newSharedBucketTestDriver(t, buckets, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostB, err := newSharedBucketTestDriver(t, buckets, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := hostA.Create(volume.Request{Name: "data", Options: map[string]string{"prefix": "dir"}}); res.Err == "" {
+		t.Error("creating a volume with a prefix in the shared bucket succeeded")
+	}
+	for _, name := range []string{"data", "database"} {
+		if res := hostA.Create(volume.Request{Name: name, Options: map[string]string{"label.team": "infra"}}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	if exist, _ := buckets.BucketExists(hostA.getGCPBucketName("data")); exist {
+		t.Error("bucket created for a volume of the shared bucket")
+	}
+	// the marker makes the empty volume visible to the other hosts, with its options
+	data, err := buckets.GetObject("shared", "data/"+volumeMarkerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var marker volumeMarker
+	if err := json.Unmarshal(data, &marker); err != nil || marker.Name != "data" || marker.Options["label.team"] != "infra" {
+		t.Errorf("volume marker %s: %v", data, err)
+	}
+	res := hostB.List(volume.Request{})
+	var listed []string
+	for _, v := range res.Volumes {
+		listed = append(listed, v.Name)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "data,database" {
+		t.Errorf("volumes listed by another host %v", listed)
+	}
+	if res := hostB.Get(volume.Request{Name: "data"}); res.Volume == nil || res.Volume.Mountpoint != hostB.getMountpoint("data") {
+		t.Errorf("volume of another host got %v", res.Volume)
+	}
+
+	// only the prefix of the removed volume is deleted, not the volumes sharing its name as prefix
+	buckets.PutObject("shared", "data/file", []byte("data"))
+	buckets.PutObject("shared", "database/file", []byte("data"))
+	if res := hostA.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	for _, name := range []string{"data/file", "data/" + volumeMarkerName} {
+		if _, err := buckets.GetObject("shared", name); err != errObjectNotFound {
+			t.Errorf("object %s of the removed volume: %v", name, err)
+		}
+	}
+	if _, err := buckets.GetObject("shared", "database/file"); err != nil {
+		t.Errorf("object of another volume deleted: %s", err)
+	}
+	// the shared bucket is kept once empty
+	if res := hostA.Remove(volume.Request{Name: "database"}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if exist, _ := buckets.BucketExists("shared"); !exist {
+		t.Error("shared bucket deleted")
+	}
+	if res := hostA.List(volume.Request{}); len(res.Volumes) != 0 {
+		t.Errorf("%d volume(s) listed after their removal", len(res.Volumes))
+	}
+	// the other host lists the removed volumes until its listing of the shared bucket expires
+	if res := hostB.List(volume.Request{}); len(res.Volumes) != 2 {
+		t.Errorf("%d volume(s) listed from the cache", len(res.Volumes))
+	}
+	hostB.remoteVolumes.invalidate()
+	if res := hostB.List(volume.Request{}); len(res.Volumes) != 0 {
+		t.Errorf("%d volume(s) listed by another host after their removal", len(res.Volumes))
+	}
+}
+
+func TestValidateVolumeName(t *testing.T) {
+	tests := map[string]bool{
+		"data":           true,
+		"my_data-1.0":    true,
+		"0data":          true,
+		"d":              false,
+		"":               false,
+		"_logs":          false,
+		"_credentials":   false,
+		".data":          false,
+		"..":             false,
+		"../data":        false,
+		"data/../../etc": false,
+		"my data":        false,
+	}
+	for name, valid := range tests {
+		if err := validateVolumeName(name); (err == nil) != valid {
+			t.Errorf("validateVolumeName(%q): %v, expected valid %t", name, err, valid)
+		}
+	}
+}
+
+func TestInvalidVolumeNames(t *testing.T) {
+	buckets := newMemoryBackend()
+	if err := buckets.CreateBucket("shared", &bucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newSharedBucketTestDriver(t, buckets, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"_logs", "../escape"} {
+		if res := d.Create(volume.Request{Name: name}); res.Err == "" {
+			t.Errorf("creating volume %s succeeded", name)
+		}
+		// the prefixes of the shared bucket which are not volume names are never discovered
+		buckets.PutObject("shared", name+"/"+volumeMarkerName, []byte(`{"name": "`+name+`"}`))
+		if res := d.Get(volume.Request{Name: name}); res.Volume != nil {
+			t.Errorf("volume %s discovered", name)
+		}
+	}
+	if exist, _ := d.isPathExist(filepath.Join(filepath.Dir(d.driverRootDir), "escape")); exist {
+		t.Error("mountpoint created out of the driver root dir")
+	}
+	if res := d.List(volume.Request{}); len(res.Volumes) != 0 {
+		t.Errorf("%d volume(s) listed", len(res.Volumes))
+	}
+
+	// a volume with an invalid name in the state file is dropped
+	rootDir := t.TempDir()
+	if err := newStateStore(rootDir).save(map[string]*gcsVolumes{
+		"../escape": {Volume: &volume.Volume{Name: "../escape"}, GcsBucketName: "shared", ExternalBucket: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	d = newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	if _, ok := d.getVolume("../escape"); ok {
+		t.Error("volume with an invalid name loaded from the state file")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// fuseLogsDirName is the dir of the driver root dir holding the FUSE process logs of the volumes
+	fuseLogsDirName = "_logs"
+	// fuseLogMaxSize is the size of a FUSE log file before its rotation
+	fuseLogMaxSize = 10 * 1024 * 1024
+	// fuseLogMaxFiles is the number of rotated FUSE log files kept per volume: volume.log.1 to volume.log.N
+	fuseLogMaxFiles = 3
+	// fuseStderrTailLines is the number of last output lines of a FUSE process reported in the mount errors
+	fuseStderrTailLines = 20
+)
+
+// fuseLog is the log file of a FUSE process, written directly by the process so that it keeps running
+// once the driver exits: the file is rotated by copy & truncate, the process writing in append mode
+type fuseLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+}
+
+// openFuseLog opens a log file in append mode, rotated once it reaches maxSize
+func openFuseLog(path string, maxSize int64, maxFiles int) (*fuseLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fuseLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		f:        f,
+	}, nil
+}
+
+// file returns the log file given as stdout & stderr to the FUSE process
+func (l *fuseLog) file() *os.File {
+	return l.f
+}
+
+// Write appends to the log file
+func (l *fuseLog) Write(p []byte) (int, error) {
+	return l.f.Write(p)
+}
+
+// size returns the current size of the log file
+func (l *fuseLog) size() int64 {
+	info, err := l.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// rotate copies the log file to its first rotated file & truncates it, if it reached its maximum size
+func (l *fuseLog) rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size() < l.maxSize {
+		return nil
+	}
+	for i := l.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	src, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(l.path+".1", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return l.f.Truncate(0)
+}
+
+// tail returns the last lines of the log file written after an offset, all of them if the file was rotated since
+func (l *fuseLog) tail(offset int64, maxLines int) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return ""
+	}
+	if offset <= int64(len(data)) {
+		data = data[offset:]
+	}
+	var lines []string
+	for _, line := range strings.Split(string(bytes.TrimSpace(data)), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Close closes the log file of the driver, the FUSE processes keep their own descriptor
+func (l *fuseLog) Close() error {
+	return l.f.Close()
+}
+
+// removeFuseLog removes a log file & its rotated files
+func removeFuseLog(path string, maxFiles int) {
+	os.Remove(path)
+	for i := 1; i <= maxFiles; i++ {
+		os.Remove(fmt.Sprintf("%s.%d", path, i))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFuseLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.log")
+	const maxSize, maxFiles = 100, 2
+	l, err := openFuseLog(path, maxSize, maxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	chunk := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 20; i++ {
+		if _, err := fmt.Fprintf(l, "%02d%s", i, chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.rotate(); err != nil {
+			t.Fatal(err)
+		}
+		// a file is rotated once it reaches its maximum size, so it never exceeds it by more than a write
+		for _, file := range []string{path, path + ".1", path + ".2"} {
+			if info, err := os.Stat(file); err == nil && info.Size() >= maxSize+int64(len(chunk)+2) {
+				t.Errorf("%s grew to %d bytes", file, info.Size())
+			}
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", path, maxFiles+1)); !os.IsNotExist(err) {
+			t.Fatalf("more than %d rotated files kept: %v", maxFiles, err)
+		}
+	}
+	// the first rotated file holds the most recent lines, the process keeps appending to the truncated file
+	data, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "15") || !strings.Contains(string(data), "17x") {
+		t.Errorf("first rotated file %q", data)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !strings.HasPrefix(string(data), "18") {
+		t.Errorf("log file %q after its last rotation: %v", data, err)
+	}
+}
+
+func TestFuseMountErrorReportsOutput(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	s := newFuseSupervisor(t.TempDir())
+	mountpoint := filepath.Join(t.TempDir(), "data")
+	// the lines written by a previous run of the process are not reported
+	previous := func() *exec.Cmd { return exec.Command("sh", "-c", "echo previous run >&2; exit 1") }
+	if err := s.start("data", mountpoint, "sh", previous); err == nil {
+		t.Fatal("process exiting before mounting started")
+	}
+	failing := func() *exec.Cmd {
+		return exec.Command("sh", "-c", `i=1; while [ $i -le 25 ]; do echo "line $i" >&2; i=$((i+1)); done; exit 1`)
+	}
+	err := s.start("data", mountpoint, "sh", failing)
+	if err == nil {
+		t.Fatal("process exiting before mounting started")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "exited before mounting") || !strings.HasSuffix(msg, "line 25") {
+		t.Errorf("mount error without the last output lines: %s", msg)
+	}
+	// only the last fuseStderrTailLines lines are reported
+	if !strings.Contains(msg, fmt.Sprintf("line %d\n", 25-fuseStderrTailLines+1)) || strings.Contains(msg, fmt.Sprintf("line %d\n", 25-fuseStderrTailLines)) {
+		t.Errorf("mount error does not end with the last %d output lines: %s", fuseStderrTailLines, msg)
+	}
+	if strings.Contains(msg, "previous run") {
+		t.Errorf("mount error reports the output of a previous run: %s", msg)
+	}
+}
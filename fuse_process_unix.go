@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// detachProcess runs a command in its own process group
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcess asks a process to exit, it is killed if still running after fuseStopTimeout
+func terminateProcess(pid int) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	go func() {
+		time.Sleep(fuseStopTimeout)
+		if isProcessAlive(pid) {
+			log.Printf("Process %d did not exit after SIGTERM, killing it\n", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// detachProcess does nothing, there are no process groups on windows
+func detachProcess(cmd *exec.Cmd) {}
+
+// terminateProcess kills a process, there are no signals on windows
+func terminateProcess(pid int) error {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Kill()
+}
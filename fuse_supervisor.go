@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fuseMountTimeout is the maximum delay for a FUSE process to mount its mountpoint
+	fuseMountTimeout = 30 * time.Second
+	// fuseStopTimeout is the maximum delay for a FUSE process to exit once its mountpoint is unmounted
+	fuseStopTimeout = 10 * time.Second
+	// fuseRestartInitialBackoff is the delay before restarting a crashed FUSE process, doubled for each following crash
+	fuseRestartInitialBackoff = time.Second
+	fuseRestartMaxBackoff     = 5 * time.Minute
+	// fuseStableAfter is the run time after which a FUSE process is considered healthy, its backoff is then reset
+	fuseStableAfter = time.Minute
+	// fuseAdoptedPollInterval is the interval between the checks of a FUSE process adopted from a previous driver process
+	fuseAdoptedPollInterval = time.Second
+	// fuseLogRotateInterval is the interval between the size checks of the FUSE log files
+	fuseLogRotateInterval = time.Minute
+)
+
+// fuseProcess is a FUSE process running in foreground & serving a host mountpoint
+type fuseProcess struct {
+	// name is the volume served by the process, naming its log file
+	name       string
+	mountpoint string
+	// tool is the name of the FUSE tool, for the logs
+	tool string
+	// newCmd creates the command running the FUSE process in foreground
+	newCmd func() *exec.Cmd
+	// log receives the stdout & stderr of the process, nil if not logged
+	log *fuseLog
+
+	// restartMu serializes the restarts & the stop of the process
+	restartMu sync.Mutex
+	stopping  bool
+	// cmd is the running process, nil while the process is down
+	cmd *exec.Cmd
+	// pid is the process adopted from a previous driver process, until its first exit
+	pid      int
+	restarts int
+	lastExit string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fuseSupervisor restarts the FUSE processes which exit while their mountpoint is in use
+type fuseSupervisor struct {
+	// logDir receives the log files of the FUSE processes, their output is discarded if empty
+	logDir    string
+	mu        sync.Mutex
+	processes map[string]*fuseProcess
+}
+
+// newFuseSupervisor creates a supervisor without any FUSE process, logging the FUSE processes output into a dir
+func newFuseSupervisor(logDir string) *fuseSupervisor {
+	return &fuseSupervisor{
+		logDir:    logDir,
+		processes: make(map[string]*fuseProcess),
+	}
+}
+
+// fuseStatus is the supervision status of the FUSE process of a mountpoint
+type fuseStatus struct {
+	Restarts int
+	LastExit string
+}
+
+// start runs the FUSE process of a volume in foreground, waits for it to mount its mountpoint & supervises it until stop;
+// the mountpoint is reserved while the process mounts it, so the other mountpoints are not blocked meanwhile
+func (s *fuseSupervisor) start(name, mountpoint, tool string, newCmd func() *exec.Cmd) error {
+	s.mu.Lock()
+	if _, ok := s.processes[mountpoint]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%s is already mounted", mountpoint)
+	}
+	p := &fuseProcess{
+		name:       name,
+		mountpoint: mountpoint,
+		tool:       tool,
+		newCmd:     newCmd,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if s.logDir != "" {
+		var err error
+		if p.log, err = openFuseLog(s.logPath(name), fuseLogMaxSize, fuseLogMaxFiles); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	// the launch holds restartMu like a restart does, stop & status wait for its end
+	p.restartMu.Lock()
+	s.processes[mountpoint] = p
+	s.mu.Unlock()
+	exited, err := p.launch()
+	if err != nil {
+		p.stopping = true
+		p.restartMu.Unlock()
+		// no supervision to wait for
+		close(p.done)
+		p.closeLog()
+		s.forget(mountpoint, p)
+		return err
+	}
+	p.restartMu.Unlock()
+	go p.supervise(exited)
+	return nil
+}
+
+// adopt supervises the running FUSE process of a volume started by a previous driver process,
+// it is restarted with newCmd once it exits
+func (s *fuseSupervisor) adopt(name, mountpoint, tool string, pid int, newCmd func() *exec.Cmd) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.processes[mountpoint]; ok {
+		return fmt.Errorf("%s is already mounted", mountpoint)
+	}
+	p := &fuseProcess{
+		name:       name,
+		mountpoint: mountpoint,
+		tool:       tool,
+		newCmd:     newCmd,
+		pid:        pid,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if s.logDir != "" {
+		var err error
+		if p.log, err = openFuseLog(s.logPath(name), fuseLogMaxSize, fuseLogMaxFiles); err != nil {
+			return err
+		}
+	}
+	// the output of the adopted process still goes to the log file it was started with, if any
+	exited := make(chan error, 1)
+	go func() {
+		for isProcessAlive(pid) {
+			time.Sleep(fuseAdoptedPollInterval)
+		}
+		exited <- fmt.Errorf("process %d exited", pid)
+	}()
+	s.processes[mountpoint] = p
+	go p.supervise(exited)
+	return nil
+}
+
+// stop unmounts the mountpoint of a supervised FUSE process & waits for the process to exit,
+// the mountpoint stays supervised if it cannot be unmounted
+func (s *fuseSupervisor) stop(mountpoint string, unmount func(mountpoint string) error) error {
+	s.mu.Lock()
+	p, ok := s.processes[mountpoint]
+	s.mu.Unlock()
+	if !ok {
+		// not started by this driver process
+		return unmount(mountpoint)
+	}
+	p.restartMu.Lock()
+	p.stopping = true
+	if err := unmount(mountpoint); err != nil {
+		// the process may be down & waiting for its restart, its mountpoint is then already unmounted
+		if mounted, _ := isMountpoint(mountpoint); mounted {
+			p.stopping = false
+			p.restartMu.Unlock()
+			return err
+		}
+	}
+	p.restartMu.Unlock()
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-time.After(fuseStopTimeout):
+		log.Printf("%s of mountpoint '%s' did not exit after the unmount, killing it\n", p.tool, mountpoint)
+		p.kill()
+		<-p.done
+	}
+	p.closeLog()
+	s.forget(mountpoint, p)
+	return nil
+}
+
+// forget drops the FUSE process of a mountpoint, unless another process was started since for the mountpoint
+func (s *fuseSupervisor) forget(mountpoint string, p *fuseProcess) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.processes[mountpoint] == p {
+		delete(s.processes, mountpoint)
+	}
+}
+
+// logPath returns the log file of the FUSE process of a volume
+func (s *fuseSupervisor) logPath(name string) string {
+	return filepath.Join(s.logDir, name+".log")
+}
+
+// removeLogs removes the log files of the FUSE process of a volume
+func (s *fuseSupervisor) removeLogs(name string) {
+	if s.logDir != "" {
+		removeFuseLog(s.logPath(name), fuseLogMaxFiles)
+	}
+}
+
+// shutdown stops the supervision of the FUSE processes before the driver exits,
+// they keep running detached & are reattached by the next driver process
+func (s *fuseSupervisor) shutdown() {
+	s.mu.Lock()
+	var mountpoints []string
+	processes := make(map[string]*fuseProcess)
+	for mountpoint, p := range s.processes {
+		mountpoints = append(mountpoints, mountpoint)
+		processes[mountpoint] = p
+	}
+	s.mu.Unlock()
+	sort.Strings(mountpoints)
+	for _, mountpoint := range mountpoints {
+		// a process being launched is waited for
+		p := processes[mountpoint]
+		p.restartMu.Lock()
+		p.stopping = true
+		p.restartMu.Unlock()
+		log.Printf("%s of mountpoint '%s' left running\n", p.tool, mountpoint)
+	}
+}
+
+// status returns the supervision status of the FUSE process of a mountpoint
+func (s *fuseSupervisor) status(mountpoint string) (fuseStatus, bool) {
+	s.mu.Lock()
+	p, ok := s.processes[mountpoint]
+	s.mu.Unlock()
+	if !ok {
+		return fuseStatus{}, false
+	}
+	p.restartMu.Lock()
+	defer p.restartMu.Unlock()
+	return fuseStatus{Restarts: p.restarts, LastExit: p.lastExit}, true
+}
+
+// pid returns the PID of the supervised FUSE process of a mountpoint, 0 while it is being launched or restarted
+func (s *fuseSupervisor) pid(mountpoint string) (int, bool) {
+	s.mu.Lock()
+	p, ok := s.processes[mountpoint]
+	s.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	p.restartMu.Lock()
+	defer p.restartMu.Unlock()
+	if p.cmd != nil {
+		return p.cmd.Process.Pid, true
+	}
+	return p.pid, true
+}
+
+// launch starts the FUSE process & waits for its mountpoint to be mounted,
+// the returned channel receives the exit of the process, with the last lines of its output
+func (p *fuseProcess) launch() (<-chan error, error) {
+	cmd := p.newCmd()
+	log.Printf("Running: $ %s\n", strings.Join(cmd.Args, " "))
+	// the process writes to its log file directly rather than through a pipe, which would break once the driver exits
+	var offset int64
+	if p.log != nil {
+		if err := p.log.rotate(); err != nil {
+			log.Printf("Rotating the log file of mountpoint '%s' failed: %s\n", p.mountpoint, err)
+		}
+		fmt.Fprintf(p.log, "--- %s Running: $ %s\n", time.Now().UTC().Format(time.RFC3339), strings.Join(cmd.Args, " "))
+		offset = p.log.size()
+		cmd.Stdout = p.log.file()
+		cmd.Stderr = p.log.file()
+	}
+	// the process does not receive the signals of the driver process group, such as a Ctrl-C
+	detachProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	withOutput := func(err error) error {
+		if p.log != nil {
+			if tail := p.log.tail(offset, fuseStderrTailLines); tail != "" {
+				err = fmt.Errorf("%s: %s", err, tail)
+			}
+		}
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			err = withOutput(err)
+		}
+		exited <- err
+	}()
+	deadline := time.After(fuseMountTimeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("exit status 0")
+			}
+			return nil, fmt.Errorf("%s exited before mounting %s: %s", p.tool, p.mountpoint, err)
+		case <-deadline:
+			cmd.Process.Kill()
+			<-exited
+			lazyUnmount(p.mountpoint)
+			return nil, withOutput(fmt.Errorf("%s did not mount %s within %s", p.tool, p.mountpoint, fuseMountTimeout))
+		case <-tick.C:
+			if mounted, _ := isMountpoint(p.mountpoint); mounted {
+				p.cmd = cmd
+				p.pid = 0
+				return exited, nil
+			}
+		}
+	}
+}
+
+// supervise waits for the exit of the FUSE process & restarts it with an exponential backoff until it is stopped
+func (p *fuseProcess) supervise(exited <-chan error) {
+	defer close(p.done)
+	backoff := fuseRestartInitialBackoff
+	started := time.Now()
+	rotate := time.NewTicker(fuseLogRotateInterval)
+	defer rotate.Stop()
+	for {
+		var err error
+	wait:
+		for {
+			select {
+			case err = <-exited:
+				break wait
+			case <-rotate.C:
+				if p.log != nil {
+					if err := p.log.rotate(); err != nil {
+						log.Printf("Rotating the log file of mountpoint '%s' failed: %s\n", p.mountpoint, err)
+					}
+				}
+			}
+		}
+		p.restartMu.Lock()
+		if p.stopping {
+			p.restartMu.Unlock()
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("exit status 0")
+		}
+		p.lastExit = fmt.Sprintf("%s: %s", time.Now().UTC().Format(time.RFC3339), err)
+		p.cmd = nil
+		p.pid = 0
+		p.restartMu.Unlock()
+		if time.Since(started) > fuseStableAfter {
+			backoff = fuseRestartInitialBackoff
+		}
+		log.Printf("%s of mountpoint '%s' exited unexpectedly: %s\n", p.tool, p.mountpoint, err)
+		for {
+			// the endpoint of the dead process fails with "Transport endpoint is not connected"
+			lazyUnmount(p.mountpoint)
+			log.Printf("Restarting %s of mountpoint '%s' in %s\n", p.tool, p.mountpoint, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return
+			}
+			if backoff *= 2; backoff > fuseRestartMaxBackoff {
+				backoff = fuseRestartMaxBackoff
+			}
+			p.restartMu.Lock()
+			if p.stopping {
+				p.restartMu.Unlock()
+				return
+			}
+			exited, err = p.launch()
+			if err == nil {
+				p.restarts++
+				log.Printf("%s of mountpoint '%s' restarted (%d restart(s))\n", p.tool, p.mountpoint, p.restarts)
+				p.restartMu.Unlock()
+				break
+			}
+			p.lastExit = fmt.Sprintf("%s: %s", time.Now().UTC().Format(time.RFC3339), err)
+			p.restartMu.Unlock()
+			log.Printf("Restarting %s of mountpoint '%s' failed: %s\n", p.tool, p.mountpoint, err)
+		}
+		started = time.Now()
+	}
+}
+
+// kill kills the FUSE process
+func (p *fuseProcess) kill() {
+	p.restartMu.Lock()
+	defer p.restartMu.Unlock()
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+	} else if p.pid != 0 {
+		if proc, err := os.FindProcess(p.pid); err == nil {
+			proc.Kill()
+		}
+	}
+}
+
+// closeLog closes the log file of the process
+func (p *fuseProcess) closeLog() {
+	if p.log != nil {
+		p.log.Close()
+	}
+}
+
+// lazyUnmount detaches a FUSE mountpoint even if its endpoint is dead or busy
+func lazyUnmount(mountpoint string) error {
+	log.Printf("Running: $ fusermount -u -z %s\n", mountpoint)
+	return exec.Command("fusermount", "-u", "-z", mountpoint).Run()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFuseSupervisorStartDoesNotBlockOtherMountpoints(t *testing.T) {
+	for _, tool := range []string{"sleep", "false"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	s := newFuseSupervisor("")
+	slowMountpoint := filepath.Join(t.TempDir(), "slow")
+	// a process never mounting its mountpoint, its launch lasts until it exits
+	slowDone := make(chan error, 1)
+	go func() {
+		slowDone <- s.start("slow", slowMountpoint, "sleep", func() *exec.Cmd { return exec.Command("sleep", "2") })
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		_, reserved := s.processes[slowMountpoint]
+		s.mu.Unlock()
+		if reserved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mountpoint %s not reserved during its launch", slowMountpoint)
+		}
+	}
+
+	if err := s.start("slow", slowMountpoint, "sleep", func() *exec.Cmd { return exec.Command("sleep", "2") }); err == nil || !strings.Contains(err.Error(), "already mounted") {
+		t.Errorf("second start of a launching mountpoint: %v", err)
+	}
+	started := time.Now()
+	err := s.start("failing", filepath.Join(t.TempDir(), "failing"), "false", func() *exec.Cmd { return exec.Command("false") })
+	if err == nil || !strings.Contains(err.Error(), "exited before mounting") {
+		t.Errorf("start of a failing process: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("start of another mountpoint waited %s for the launching one", elapsed)
+	}
+
+	if err := <-slowDone; err == nil || !strings.Contains(err.Error(), "exited before mounting") {
+		t.Errorf("start of a process exiting before mounting: %v", err)
+	}
+	// a failed launch releases its mountpoint
+	if _, ok := s.status(slowMountpoint); ok {
+		t.Errorf("mountpoint %s still supervised after a failed start", slowMountpoint)
+	}
+	if err := s.stop(slowMountpoint, func(string) error { return nil }); err != nil {
+		t.Errorf("stop of a mountpoint without process: %v", err)
+	}
+}
+
+// startFakeFuse starts under a supervisor a process standing for a FUSE process: it "mounts" its mountpoint
+// by turning it into a symlink to /proc, which is on another device, & exits once the symlink is removed
+func startFakeFuse(t *testing.T, s *fuseSupervisor, mountpoint string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	err := s.start("fake", mountpoint, "sh", func() *exec.Cmd {
+		return exec.Command("sh", "-c", `ln -sfn /proc "$0" && while [ -L "$0" ]; do sleep 0.1; done`, mountpoint)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForRestart waits for the supervised process of a mountpoint to be restarted & returns its PID
+func waitForRestart(t *testing.T, s *fuseSupervisor, mountpoint string, restarts int) int {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status, _ := s.status(mountpoint)
+		if pid, _ := s.pid(mountpoint); status.Restarts == restarts && pid != 0 {
+			return pid
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process of %s not restarted: %+v", mountpoint, status)
+		}
+	}
+}
+
+func TestFuseSupervisorRestartsKilledProcess(t *testing.T) {
+	s := newFuseSupervisor("")
+	mountpoint := filepath.Join(t.TempDir(), "data")
+	startFakeFuse(t, s, mountpoint)
+	pid, ok := s.pid(mountpoint)
+	if !ok || pid == 0 {
+		t.Fatalf("process of %s not supervised", mountpoint)
+	}
+
+	// the delay before a restart doubles for each crash
+	for i, backoff := range []time.Duration{fuseRestartInitialBackoff, 2 * fuseRestartInitialBackoff} {
+		killed := time.Now()
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+			t.Fatal(err)
+		}
+		restarted := waitForRestart(t, s, mountpoint, i+1)
+		if elapsed := time.Since(killed); elapsed < backoff {
+			t.Errorf("restart %d after %s, expected a backoff of %s", i+1, elapsed, backoff)
+		}
+		if restarted == pid {
+			t.Errorf("restart %d: the killed process %d is still supervised", i+1, pid)
+		}
+		if status, _ := s.status(mountpoint); !strings.Contains(status.LastExit, "signal: killed") {
+			t.Errorf("restart %d: last exit %q", i+1, status.LastExit)
+		}
+		pid = restarted
+	}
+
+	// an unmounted process is not restarted
+	if err := s.stop(mountpoint, os.Remove); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.status(mountpoint); ok {
+		t.Errorf("mountpoint %s still supervised after its stop", mountpoint)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("process %d still running after its stop", pid)
+	}
+}
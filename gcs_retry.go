@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// gcsRetryPolicy defines how the GCStorage calls are retried & the deadline of each call attempt
+type gcsRetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an idempotent call, 1 disables the retries
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled for each following retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MetadataTimeout is the deadline of the bucket & object metadata calls
+	MetadataTimeout time.Duration
+	// ListTimeout is the deadline of a listing call, per page
+	ListTimeout time.Duration
+	// DataTimeout is the deadline of an object read or write
+	DataTimeout time.Duration
+}
+
+// defaultGcsRetryPolicy is the retry policy of the GCStorage calls when none is configured
+var defaultGcsRetryPolicy = gcsRetryPolicy{
+	MaxAttempts:     5,
+	InitialBackoff:  500 * time.Millisecond,
+	MaxBackoff:      16 * time.Second,
+	MetadataTimeout: 30 * time.Second,
+	ListTimeout:     60 * time.Second,
+	DataTimeout:     120 * time.Second,
+}
+
+// call runs a GCStorage call with a deadline, an idempotent call is retried with an exponential backoff
+// as long as it fails with a retryable error
+func (p *gcsRetryPolicy) call(op string, timeout time.Duration, idempotent bool, fn func(ctx context.Context) error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := fn(ctx)
+		cancel()
+		if err == nil || !idempotent || attempt >= p.MaxAttempts || !isRetryableGCSError(err) {
+			return err
+		}
+		// full jitter, so that concurrent calls do not retry in lockstep
+		delay := time.Duration(rand.Int63n(int64(backoff))) + 1
+		log.Printf("Google Cloud Storage %s: attempt %d/%d failed: %s, retrying in %s\n", op, attempt, p.MaxAttempts, err, delay)
+		time.Sleep(delay)
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// isRetryableGCSError returns true if a GCStorage call failed with a transient error:
+// the retryable HTTP status codes of GCS (408, 429 & 5xx), a deadline exceeded or a network error
+func isRetryableGCSError(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return e.Code == http.StatusRequestTimeout || e.Code == http.StatusTooManyRequests || e.Code >= 500
+	case *url.Error:
+		return isRetryableGCSError(e.Err)
+	case net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded || err == io.ErrUnexpectedEOF || err == io.EOF
+}
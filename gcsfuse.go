@@ -5,32 +5,77 @@ import (
 	"os/exec"
 )
 
-// mountGcsfuse mounts a GCStorage bucket on a host dir using gcsfuse
-func (d *gcpVolDriver) mountGcsfuse(volumeName string) error {
-	// get host mountpoint path
-	m := d.getMountpoint(volumeName)
-	// get GCS bucket name
-	bucketName := d.getGCPBucketName(volumeName)
+// Mounter mounts the bucket of a volume as a file system on a host mountpoint
+type Mounter interface {
+	// Mount mounts the bucket of a volume on a host mountpoint
+	Mount(v *gcsVolumes, mountpoint string) error
+	// Unmount unmounts a host mountpoint
+	Unmount(mountpoint string) error
+}
+
+// gcsfuseMounter mounts GCStorage buckets using gcsfuse
+type gcsfuseMounter struct {
+	// keyFilePath is the GCP service key file of gcsfuse, which uses the Application Default Credentials if empty
+	keyFilePath string
+	// supervisor restarts the gcsfuse processes, shared by the mounters of every GCP identity
+	supervisor *fuseSupervisor
+}
+
+// newGcsfuseMounter creates a gcsfuse mounter authenticated with a GCP service key file
+func newGcsfuseMounter(keyFilePath string, supervisor *fuseSupervisor) *gcsfuseMounter {
+	return &gcsfuseMounter{
+		keyFilePath: keyFilePath,
+		supervisor:  supervisor,
+	}
+}
+
+// Mount mounts a GCStorage bucket on a host dir using gcsfuse, run in foreground & restarted if it exits
+func (g *gcsfuseMounter) Mount(v *gcsVolumes, mountpoint string) error {
 	// mount GCStorage bucket on host mounpoint
-	log.Printf("Mounting host mountpoint '%s' to Google Cloud Storage Bucket '%s'\n", m, bucketName)
-	log.Printf("Running: $ gcsfuse --key-file %s %s %s\n", d.gcpServiceKeyPath, bucketName, m)
-	cmd := exec.Command("gcsfuse", "--key-file", d.gcpServiceKeyPath, bucketName, m)
-	if err := cmd.Run(); err != nil {
-		return err
+	log.Printf("Mounting host mountpoint '%s' to Google Cloud Storage Bucket '%s'\n", mountpoint, v.GcsBucketName)
+	return g.supervisor.start(v.Volume.Name, mountpoint, "gcsfuse", g.command(v, mountpoint))
+}
+
+// Reattach supervises the gcsfuse process serving a mountpoint, started by a previous driver process,
+// it returns false if no gcsfuse process serves the mountpoint
+func (g *gcsfuseMounter) Reattach(v *gcsVolumes, mountpoint string) (bool, error) {
+	pid, ok := findFuseProcess("gcsfuse", mountpoint)
+	if !ok {
+		return false, nil
 	}
-	return nil
+	log.Printf("Reattaching gcsfuse process %d of host mountpoint '%s'\n", pid, mountpoint)
+	if err := g.supervisor.adopt(v.Volume.Name, mountpoint, "gcsfuse", pid, g.command(v, mountpoint)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// command returns the function creating the gcsfuse command mounting the bucket of a volume in foreground
+func (g *gcsfuseMounter) command(v *gcsVolumes, mountpoint string) func() *exec.Cmd {
+	args := []string{"--foreground"}
+	if g.keyFilePath != "" {
+		args = append(args, "--key-file", g.keyFilePath)
+	}
+	if v.Prefix != "" {
+		args = append(args, "--only-dir", v.Prefix)
+	}
+	args = append(args, gcsfuseArgs(v.GcsfuseOptions)...)
+	args = append(args, v.GcsBucketName, mountpoint)
+	return func() *exec.Cmd {
+		return exec.Command("gcsfuse", args...)
+	}
+}
+
+// Unmount unmounts a mounted GCStorage bucket on a host dir & stops its gcsfuse process
+func (g *gcsfuseMounter) Unmount(mountpoint string) error {
+	return g.supervisor.stop(mountpoint, fusermountUnmount)
 }
 
-// unmountGcsfuse unmounts a mounted GCStorage bucket on a host dir
-func (d *gcpVolDriver) unmountGcsfuse(volumeName string) error {
-	// get host mountpoint path
-	m := d.getMountpoint(volumeName)
-	// get GCS bucket name
-	bucketName := d.getGCPBucketName(volumeName)
-	// unmount the GCS bucket
-	log.Printf("Unmounting host mountpoint '%s' from Google Cloud Storage Bucket '%s'\n", m, bucketName)
-	log.Printf("Running: $ fusermount -u %s\n", m)
-	cmd := exec.Command("fusermount", "-u", m)
+// fusermountUnmount unmounts a FUSE file system mounted on a host dir
+func fusermountUnmount(mountpoint string) error {
+	log.Printf("Unmounting host mountpoint '%s'\n", mountpoint)
+	log.Printf("Running: $ fusermount -u %s\n", mountpoint)
+	cmd := exec.Command("fusermount", "-u", mountpoint)
 	if err := cmd.Run(); err != nil {
 		return err
 	}
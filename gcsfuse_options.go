@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsfuseOptionPrefix prefixes the volume options passed to gcsfuse: gcsfuse.flag=value
+const gcsfuseOptionPrefix = "gcsfuse."
+
+// gcsfuseFlagKind defines how the value of a gcsfuse flag is validated
+type gcsfuseFlagKind int
+
+const (
+	gcsfuseBool gcsfuseFlagKind = iota
+	gcsfuseID
+	gcsfuseMode
+	gcsfuseDuration
+	gcsfuseRate
+)
+
+// gcsfuseFlags is the whitelist of the gcsfuse flags settable per volume,
+// the flags managed by the driver (key file, mounted dir, logs...) or giving access to the host are not settable
+var gcsfuseFlags = map[string]gcsfuseFlagKind{
+	"implicit-dirs":     gcsfuseBool,
+	"uid":               gcsfuseID,
+	"gid":               gcsfuseID,
+	"file-mode":         gcsfuseMode,
+	"dir-mode":          gcsfuseMode,
+	"stat-cache-ttl":    gcsfuseDuration,
+	"type-cache-ttl":    gcsfuseDuration,
+	"limit-ops-per-sec": gcsfuseRate,
+	// ro mounts the bucket read-only: -o ro
+	"ro": gcsfuseBool,
+	// debug logs the GCS requests & the FUSE operations: --debug_gcs --debug_fuse
+	"debug": gcsfuseBool,
+}
+
+// parseGcsfuseOptions returns the gcsfuse flags defined by the volume options gcsfuse.flag=value,
+// the values are normalized & an unknown flag or an invalid value is an error
+func parseGcsfuseOptions(options map[string]string) (map[string]string, error) {
+	flags := make(map[string]string)
+	for opt, value := range options {
+		if !strings.HasPrefix(opt, gcsfuseOptionPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(opt, gcsfuseOptionPrefix)
+		kind, ok := gcsfuseFlags[name]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported gcsfuse option %s, the supported options are: %s", name, strings.Join(gcsfuseFlagNames(), ", "))
+		}
+		normalized, err := validateGcsfuseFlag(kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value %s of gcsfuse option %s: %s", value, name, err)
+		}
+		flags[name] = normalized
+	}
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	return flags, nil
+}
+
+// validateGcsfuseFlag checks the value of a gcsfuse flag & returns its normalized form
+func validateGcsfuseFlag(kind gcsfuseFlagKind, value string) (string, error) {
+	switch kind {
+	case gcsfuseBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("expected true or false")
+		}
+		return strconv.FormatBool(b), nil
+	case gcsfuseID:
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || id == math.MaxUint32 {
+			return "", fmt.Errorf("expected a numeric uid or gid")
+		}
+		return strconv.FormatUint(id, 10), nil
+	case gcsfuseMode:
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return "", fmt.Errorf("expected octal permission bits, e.g. 644")
+		}
+		return fmt.Sprintf("%o", mode), nil
+	case gcsfuseDuration:
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return "", fmt.Errorf("expected a duration, e.g. 1m")
+		}
+		return ttl.String(), nil
+	case gcsfuseRate:
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(rate) || math.IsInf(rate, 0) || (rate <= 0 && rate != -1) {
+			return "", fmt.Errorf("expected a positive number of operations per second, or -1 for no limit")
+		}
+		return strconv.FormatFloat(rate, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unknown option kind")
+}
+
+// gcsfuseFlagNames returns the sorted names of the gcsfuse flags settable per volume
+func gcsfuseFlagNames() []string {
+	var names []string
+	for name := range gcsfuseFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gcsfuseArgs returns the gcsfuse command line arguments of the gcsfuse flags of a volume
+func gcsfuseArgs(flags map[string]string) []string {
+	var names []string
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		value := flags[name]
+		switch {
+		case name == "ro":
+			if value == "true" {
+				args = append(args, "-o", "ro")
+			}
+		case name == "debug":
+			if value == "true" {
+				args = append(args, "--debug_gcs", "--debug_fuse")
+			}
+		case gcsfuseFlags[name] == gcsfuseBool:
+			if value == "true" {
+				args = append(args, "--"+name)
+			}
+		default:
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+	return args
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestParseGcsfuseOptions(t *testing.T) {
+	tests := []struct {
+		options  map[string]string
+		expected map[string]string
+		err      string
+	}{
+		// the options of the other components are ignored
+		{map[string]string{"location": "EU"}, nil, ""},
+		{
+			map[string]string{
+				"gcsfuse.implicit-dirs":     "1",
+				"gcsfuse.uid":               "1000",
+				"gcsfuse.gid":               "0",
+				"gcsfuse.file-mode":         "0644",
+				"gcsfuse.dir-mode":          "755",
+				"gcsfuse.stat-cache-ttl":    "90s",
+				"gcsfuse.type-cache-ttl":    "0",
+				"gcsfuse.limit-ops-per-sec": "-1",
+				"gcsfuse.ro":                "TRUE",
+				"gcsfuse.debug":             "false",
+			},
+			map[string]string{
+				"implicit-dirs":     "true",
+				"uid":               "1000",
+				"gid":               "0",
+				"file-mode":         "644",
+				"dir-mode":          "755",
+				"stat-cache-ttl":    "1m30s",
+				"type-cache-ttl":    "0s",
+				"limit-ops-per-sec": "-1",
+				"ro":                "true",
+				"debug":             "false",
+			},
+			"",
+		},
+		{map[string]string{"gcsfuse.limit-ops-per-sec": "2.5"}, map[string]string{"limit-ops-per-sec": "2.5"}, ""},
+		// the flags managed by the driver or giving access to the host
+		{map[string]string{"gcsfuse.key-file": "/etc/shadow"}, nil, "Unsupported gcsfuse option key-file"},
+		{map[string]string{"gcsfuse.only-dir": "other"}, nil, "Unsupported gcsfuse option only-dir"},
+		{map[string]string{"gcsfuse.foreground": "false"}, nil, "Unsupported gcsfuse option foreground"},
+		{map[string]string{"gcsfuse.temp-dir": "/"}, nil, "Unsupported gcsfuse option temp-dir"},
+		{map[string]string{"gcsfuse.o": "allow_other"}, nil, "Unsupported gcsfuse option o"},
+		{map[string]string{"gcsfuse.": "true"}, nil, "Unsupported gcsfuse option "},
+		{map[string]string{"gcsfuse.implicit_dirs": "true"}, nil, "Unsupported gcsfuse option implicit_dirs"},
+		// the values are validated before reaching the command line
+		{map[string]string{"gcsfuse.implicit-dirs": "yes"}, nil, "Invalid value yes of gcsfuse option implicit-dirs: expected true or false"},
+		{map[string]string{"gcsfuse.ro": "true --key-file=/etc/shadow"}, nil, "Invalid value true --key-file=/etc/shadow of gcsfuse option ro"},
+		{map[string]string{"gcsfuse.uid": "root"}, nil, "Invalid value root of gcsfuse option uid: expected a numeric uid or gid"},
+		{map[string]string{"gcsfuse.uid": "-1"}, nil, "Invalid value -1 of gcsfuse option uid"},
+		{map[string]string{"gcsfuse.gid": "4294967295"}, nil, "Invalid value 4294967295 of gcsfuse option gid"},
+		{map[string]string{"gcsfuse.file-mode": "0888"}, nil, "Invalid value 0888 of gcsfuse option file-mode: expected octal permission bits"},
+		{map[string]string{"gcsfuse.dir-mode": "4755"}, nil, "Invalid value 4755 of gcsfuse option dir-mode"},
+		{map[string]string{"gcsfuse.stat-cache-ttl": "1 minute"}, nil, "Invalid value 1 minute of gcsfuse option stat-cache-ttl: expected a duration"},
+		{map[string]string{"gcsfuse.type-cache-ttl": "-1s"}, nil, "Invalid value -1s of gcsfuse option type-cache-ttl"},
+		{map[string]string{"gcsfuse.limit-ops-per-sec": "0"}, nil, "Invalid value 0 of gcsfuse option limit-ops-per-sec: expected a positive number"},
+		{map[string]string{"gcsfuse.limit-ops-per-sec": "NaN"}, nil, "Invalid value NaN of gcsfuse option limit-ops-per-sec"},
+		{map[string]string{"gcsfuse.limit-ops-per-sec": "+Inf"}, nil, "Invalid value +Inf of gcsfuse option limit-ops-per-sec"},
+	}
+	for _, test := range tests {
+		flags, err := parseGcsfuseOptions(test.options)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("parseGcsfuseOptions(%v): error %v, expected %s", test.options, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(flags, test.expected) {
+			t.Errorf("parseGcsfuseOptions(%v) = %v, %v, expected %v", test.options, flags, err, test.expected)
+		}
+	}
+}
+
+func TestGcsfuseCommandLine(t *testing.T) {
+	tests := []struct {
+		flags    map[string]string
+		expected []string
+	}{
+		{nil, nil},
+		{map[string]string{"implicit-dirs": "false", "ro": "false", "debug": "false"}, nil},
+		{
+			map[string]string{"uid": "1000", "implicit-dirs": "true", "ro": "true", "debug": "true", "file-mode": "644", "stat-cache-ttl": "1m0s"},
+			[]string{"--debug_gcs", "--debug_fuse", "--file-mode=644", "--implicit-dirs", "-o", "ro", "--stat-cache-ttl=1m0s", "--uid=1000"},
+		},
+	}
+	for _, test := range tests {
+		if args := gcsfuseArgs(test.flags); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("gcsfuseArgs(%v) = %q, expected %q", test.flags, args, test.expected)
+		}
+	}
+
+	// the flags of the volume come after the flags of the driver & before the bucket & the mountpoint
+	g := newGcsfuseMounter("/etc/gcs/key.json", nil)
+	v := &gcsVolumes{GcsBucketName: "test-project_shared", Prefix: "data", GcsfuseOptions: map[string]string{"ro": "true", "uid": "1000"}}
+	cmd := g.command(v, "/mnt/data")()
+	expected := []string{"gcsfuse", "--foreground", "--key-file", "/etc/gcs/key.json", "--only-dir", "data", "-o", "ro", "--uid=1000", "test-project_shared", "/mnt/data"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("gcsfuse command line %q, expected %q", cmd.Args, expected)
+	}
+}
+
+func TestGcsfuseOptionsRoundTrip(t *testing.T) {
+	buckets := newMemoryBackend()
+	rootDir := t.TempDir()
+	d := newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	options := map[string]string{"gcsfuse.uid": "1000", "gcsfuse.file-mode": "0640", "gcsfuse.ro": "1"}
+	expected := map[string]string{"uid": "1000", "file-mode": "640", "ro": "true"}
+	if res := d.Create(volume.Request{Name: "data", Options: options}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if v := d.mountedBuckets["data"]; v == nil || !reflect.DeepEqual(v.GcsfuseOptions, expected) {
+		t.Errorf("gcsfuse options of the created volume: %+v", v)
+	}
+
+	// the normalized options are restored from the state file
+	restarted := newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	if v := restarted.mountedBuckets["data"]; v == nil || !reflect.DeepEqual(v.GcsfuseOptions, expected) {
+		t.Errorf("gcsfuse options restored from the state file: %+v", v)
+	}
+
+	// the options are restored from the volume marker of a shared bucket by the other hosts
+	if err := buckets.CreateBucket("shared", &bucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hostA, err := newSharedBucketTestDriver(t, buckets, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostB, err := newSharedBucketTestDriver(t, buckets, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := hostA.Create(volume.Request{Name: "shared-data", Options: options}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if v, ok, err := hostB.discoverVolume("shared-data"); err != nil || !ok || !reflect.DeepEqual(v.GcsfuseOptions, expected) {
+		t.Errorf("gcsfuse options restored from the volume marker: %+v, %v", v, err)
+	}
+}
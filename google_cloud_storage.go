@@ -1,172 +1,549 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	gstorage "google.golang.org/api/storage/v1"
 	"google.golang.org/cloud"
+	"google.golang.org/cloud/compute/metadata"
 	gcloudstorage "google.golang.org/cloud/storage"
 )
 
-// getGCPProjectID returns the unique ID of the Google Cloud Platform project defined in the service key JSON
-func getGCPProjectID(jsonKeyPath string) (string, error) {
-	var gcpServiceAccount map[string]string
+// gcsBucketsURL is the JSON API endpoint of the GCStorage buckets, used for the bucket fields
+// unsupported by the storage/v1 client such as labels
+const gcsBucketsURL = "https://www.googleapis.com/storage/v1/b/"
+
+// gcsClockSkew is the tolerated difference between the clocks of the host & GCS when comparing creation times
+const gcsClockSkew = time.Minute
+
+// gcsBackend is the Google Cloud Storage implementation of BucketBackend
+type gcsBackend struct {
+	buckets      *gstorage.BucketsService
+	client       *gcloudstorage.Client
+	httpClient   *http.Client
+	gcpProjectID string
+	defaults     *bucketOptions
+	retry        *gcsRetryPolicy
+}
+
+// gcsBucketLabels is the labels field of a GCStorage bucket resource
+type gcsBucketLabels struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// serviceAccountKey is the content of a GCP service account key JSON required by the driver
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// loadServiceAccountKey reads & validates a GCP service account key JSON
+func loadServiceAccountKey(jsonKeyPath string) (*serviceAccountKey, error) {
 	file, err := ioutil.ReadFile(jsonKeyPath)
 	if err != nil {
-		return "", nil
+		return nil, fmt.Errorf("GCP service account key %s cannot be read: %s", jsonKeyPath, err)
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(file, &key); err != nil {
+		return nil, fmt.Errorf("GCP service account key %s is not valid JSON: %s", jsonKeyPath, err)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("GCP service account key %s has type '%s', a key of type 'service_account' is expected", jsonKeyPath, key.Type)
+	}
+	if key.ProjectID == "" {
+		return nil, fmt.Errorf("GCP service account key %s has no project_id", jsonKeyPath)
+	}
+	if key.ClientEmail == "" {
+		return nil, fmt.Errorf("GCP service account key %s has no client_email", jsonKeyPath)
 	}
-	json.Unmarshal(file, &gcpServiceAccount)
-	gcpProjectID := gcpServiceAccount["project_id"]
-	log.Printf("GCP Project ID: %s\n", gcpProjectID)
-	return gcpProjectID, nil
+	if key.PrivateKey == "" {
+		return nil, fmt.Errorf("GCP service account key %s has no private_key", jsonKeyPath)
+	}
+	return &key, nil
 }
 
-// getGCPBucketName defines the name of a GCStorage bucket based on GCP project ID & volume name
-func (d *gcpVolDriver) getGCPBucketName(volumeName string) string {
-	return fmt.Sprintf("%s_%s", d.gcpProjectID, volumeName)
+// getGCPProjectID returns the unique ID of the Google Cloud Platform project defined in the service key JSON
+func getGCPProjectID(jsonKeyPath string) (string, error) {
+	key, err := loadServiceAccountKey(jsonKeyPath)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("GCP Project ID: %s (service account %s)\n", key.ProjectID, key.ClientEmail)
+	return key.ProjectID, nil
 }
 
-// newGoogleStorageBucketsService creates a GCStorage BucketService from the GCP service key file
-func newGoogleStorageBucketsService(keyfilePath string) (*gstorage.BucketsService, error) {
-	jsonKey, err := ioutil.ReadFile(keyfilePath)
+// newGcsBackend creates a Google Cloud Storage backend authenticated with the GCP service key file,
+// or with the Application Default Credentials if there is no key file,
+// the buckets are created with the default location & storage class unless defined per volume
+func newGcsBackend(keyfilePath, gcpProjectID string, defaults *bucketOptions, retry *gcsRetryPolicy) (*gcsBackend, error) {
+	tokenSource, err := newGoogleTokenSource(keyfilePath)
 	if err != nil {
 		return nil, err
 	}
-	conf, err := google.JWTConfigFromJSON(
-		jsonKey,
-		gstorage.CloudPlatformScope,
-	)
+	return newGcsBackendWithTokenSource(tokenSource, gcpProjectID, defaults, retry)
+}
+
+// newGcsBackendWithTokenSource creates a Google Cloud Storage backend authenticated with an OAuth2 token source
+func newGcsBackendWithTokenSource(tokenSource oauth2.TokenSource, gcpProjectID string, defaults *bucketOptions, retry *gcsRetryPolicy) (*gcsBackend, error) {
+	if err := validateBucketOptions(defaults); err != nil {
+		return nil, err
+	}
+	if retry == nil {
+		retry = &defaultGcsRetryPolicy
+	}
+	httpClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
+	buckets, err := newGoogleStorageBucketsService(httpClient)
 	if err != nil {
 		return nil, err
 	}
-	storageService, err := gstorage.New(conf.Client(oauth2.NoContext))
+	client, err := newGoogleCloudStorageClient(tokenSource)
 	if err != nil {
 		return nil, err
 	}
-	return storageService.Buckets, err
+	return &gcsBackend{
+		buckets:      buckets,
+		client:       client,
+		httpClient:   httpClient,
+		gcpProjectID: gcpProjectID,
+		defaults:     defaults,
+		retry:        retry,
+	}, nil
 }
 
-// newGoogleCloudStorageClient creates a Google Cloud Platform client used for BucketService unsupported actions
-func newGoogleCloudStorageClient(keyfilePath string) (*gcloudstorage.Client, error) {
-	jsonKey, err := ioutil.ReadFile(keyfilePath)
+// newGoogleTokenSource creates the OAuth2 token source of the GCP API calls:
+// from the GCP service key file if defined, or else from the GCE metadata server if GCE_METADATA_HOST is defined,
+// or else from the Application Default Credentials
+// ($GOOGLE_APPLICATION_CREDENTIALS, gcloud config or the metadata server on GCE & GKE)
+func newGoogleTokenSource(keyfilePath string) (oauth2.TokenSource, error) {
+	if keyfilePath != "" {
+		jsonKey, err := ioutil.ReadFile(keyfilePath)
+		if err != nil {
+			return nil, err
+		}
+		conf, err := google.JWTConfigFromJSON(
+			jsonKey,
+			gstorage.CloudPlatformScope,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return conf.TokenSource(oauth2.NoContext), nil
+	}
+	if os.Getenv("GCE_METADATA_HOST") != "" {
+		log.Printf("GCP credentials: metadata server %s\n", os.Getenv("GCE_METADATA_HOST"))
+		return oauth2.ReuseTokenSource(nil, metadataTokenSource{}), nil
+	}
+	log.Println("GCP credentials: Application Default Credentials")
+	return google.DefaultTokenSource(oauth2.NoContext, gstorage.CloudPlatformScope)
+}
+
+// metadataTokenSource gets the tokens of the default service account from the metadata server defined by GCE_METADATA_HOST,
+// unlike google.ComputeTokenSource which requires to run on GCE
+type metadataTokenSource struct{}
+
+// Token returns a token of the default service account from the metadata server
+func (metadataTokenSource) Token() (*oauth2.Token, error) {
+	data, err := metadata.Get("instance/service-accounts/default/token")
 	if err != nil {
 		return nil, err
 	}
-	conf, err := google.JWTConfigFromJSON(
-		jsonKey,
-		gcloudstorage.ScopeFullControl,
-	)
+	var res struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresInSec int    `json:"expires_in"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		return nil, err
+	}
+	if res.AccessToken == "" {
+		return nil, fmt.Errorf("incomplete token received from the metadata server")
+	}
+	return &oauth2.Token{
+		AccessToken: res.AccessToken,
+		TokenType:   res.TokenType,
+		Expiry:      time.Now().Add(time.Duration(res.ExpiresInSec) * time.Second),
+	}, nil
+}
+
+// resolveGCPProjectID returns the GCP project holding the buckets:
+// the project of the GCP service key file, or else the project defined by the driver flag, or else the project of the metadata server
+func resolveGCPProjectID(keyfilePath, projectID string) (string, error) {
+	if keyfilePath != "" {
+		return getGCPProjectID(keyfilePath)
+	}
+	if projectID != "" {
+		log.Printf("GCP Project ID: %s\n", projectID)
+		return projectID, nil
+	}
+	if os.Getenv("GCE_METADATA_HOST") == "" && !metadata.OnGCE() {
+		return "", fmt.Errorf("GCP project ID unknown: not running on GCE, define the project with -project")
+	}
+	projectID, err := metadata.ProjectID()
+	if err != nil {
+		return "", fmt.Errorf("GCP project ID lookup from the metadata server failed: %s", err)
+	}
+	log.Printf("GCP Project ID (metadata server): %s\n", projectID)
+	return projectID, nil
+}
+
+// newGoogleStorageBucketsService creates a GCStorage BucketService from an authenticated HTTP client
+func newGoogleStorageBucketsService(httpClient *http.Client) (*gstorage.BucketsService, error) {
+	storageService, err := gstorage.New(httpClient)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	client, err := gcloudstorage.NewClient(
-		ctx,
-		cloud.WithTokenSource(conf.TokenSource(ctx)),
+	return storageService.Buckets, err
+}
+
+// newGoogleCloudStorageClient creates a Google Cloud Platform client used for BucketService unsupported actions
+func newGoogleCloudStorageClient(tokenSource oauth2.TokenSource) (*gcloudstorage.Client, error) {
+	return gcloudstorage.NewClient(
+		context.Background(),
+		cloud.WithTokenSource(tokenSource),
 	)
-	return client, err
 }
 
-// emptyGCSBucket empties the content of a Google Cloud Storage bucket, without deleting the bucket itself
-func (d *gcpVolDriver) emptyGCSBucket(client *gcloudstorage.Client, bucketName string) error {
-	bucketHandler := client.Bucket(bucketName)
-	ctx := context.Background()
-	list, err := bucketHandler.List(ctx, &gcloudstorage.Query{})
-	if err != nil {
+// checkAccess checks that the driver identity can list the GCStorage buckets of the GCP project
+func (b *gcsBackend) checkAccess() error {
+	err := b.retry.call("list buckets", b.retry.ListTimeout, true, func(ctx context.Context) error {
+		_, err := b.buckets.List(b.gcpProjectID).MaxResults(1).Fields("items/name").Context(ctx).Do()
 		return err
+	})
+	if err == nil {
+		log.Printf("GCP credentials can access the buckets of the project '%s'\n", b.gcpProjectID)
+		return nil
 	}
-	for _, r := range list.Results {
-		log.Printf("Deleting object '%+s' from GCS Bucket '%s'\n", r.Name, bucketName)
-		if err := bucketHandler.Object(r.Name).Delete(ctx); err != nil {
-			return err
+	if e, ok := err.(*googleapi.Error); ok {
+		switch e.Code {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("GCP credentials rejected, the service account key may be revoked: %s", e.Message)
+		case http.StatusForbidden:
+			return fmt.Errorf("GCP credentials are not allowed to list the buckets of the project '%s', grant the Storage Admin role: %s", b.gcpProjectID, e.Message)
+		case http.StatusNotFound, http.StatusBadRequest:
+			return fmt.Errorf("GCP project '%s' not found: %s", b.gcpProjectID, e.Message)
 		}
 	}
-	return nil
+	return fmt.Errorf("GCP preflight check on the project '%s' failed: %s", b.gcpProjectID, err)
 }
 
-// IsGCSBucketExist returns true if a GCStorage bucket with a name GCPprojectID_volumeName exists
-func (d *gcpVolDriver) IsGCSBucketExist(bucketName string) (bool, error) {
-	buckets, err := d.gcpClient.List(d.gcpProjectID).Do()
-	if err != nil {
+// BucketExists returns true if a GCStorage bucket exists in the GCP project
+func (b *gcsBackend) BucketExists(bucketName string) (bool, error) {
+	err := b.retry.call("get bucket", b.retry.MetadataTimeout, true, func(ctx context.Context) error {
+		_, err := b.buckets.Get(bucketName).Fields("name").Context(ctx).Do()
+		return err
+	})
+	switch err := gcsBucketError(err); err {
+	case nil:
+		log.Printf("Google Cloud Storage bucket '%s' already exists\n", bucketName)
+		return true, nil
+	case errBucketNotFound:
+		log.Printf("There is no bucket named '%s' on Google Cloud Storage\n", bucketName)
+		return false, nil
+	default:
 		return false, err
 	}
-	for _, b := range buckets.Items {
-		if b.Name == bucketName {
-			log.Printf("Google Cloude Storage bucket '%s' already exists\n", bucketName)
-			return true, nil
+}
+
+// gcsBucketError translates the GCStorage errors of a bucket request:
+// 404 into errBucketNotFound & 403 into errBucketForbidden, any other error is returned as is
+func gcsBucketError(err error) error {
+	if e, ok := err.(*googleapi.Error); ok {
+		switch e.Code {
+		case http.StatusNotFound:
+			return errBucketNotFound
+		case http.StatusForbidden:
+			return errBucketForbidden
 		}
 	}
-	log.Printf("There is no bucket named '%s' on Google Cloud Storage\n", bucketName)
-	return false, nil
+	return err
 }
 
-// createGCPStorageBucket creates a bucket on GCStorage from its name
-func (d *gcpVolDriver) createGCPStorageBucket(bucketName string) (*gstorage.Bucket, error) {
-	bucket, err := d.gcpClient.Insert(
-		d.gcpProjectID,
-		&gstorage.Bucket{
-			Name:         bucketName,
-			Location:     "US",
-			StorageClass: "STANDARD",
-		}).Do()
+// CreateBucket creates a bucket on GCStorage from its name
+func (b *gcsBackend) CreateBucket(bucketName string, opts *bucketOptions) error {
+	location := b.defaults.Location
+	if opts.Location != "" {
+		location = opts.Location
+	}
+	storageClass := b.defaults.StorageClass
+	if opts.StorageClass != "" {
+		storageClass = opts.StorageClass
+	}
+	// an attempt failing on the client side may have created the bucket, the following attempts then conflict with it
+	start := time.Now()
+	attempts := 0
+	err := b.retry.call("create bucket", b.retry.MetadataTimeout, true, func(ctx context.Context) error {
+		attempts++
+		_, err := b.buckets.Insert(
+			b.gcpProjectID,
+			&gstorage.Bucket{
+				Name:         bucketName,
+				Location:     location,
+				StorageClass: storageClass,
+			}).Context(ctx).Do()
+		return err
+	})
+	if err != nil && attempts > 1 && isGCSError(err, http.StatusConflict) && b.isCreatedBucket(bucketName, start, location, storageClass) {
+		log.Printf("Google Cloud Storage Bucket '%s' was created by a previous attempt\n", bucketName)
+		err = nil
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Printf("Google Cloud Storage Bucket '%s' created for the project '%s'\n", bucketName, d.gcpProjectID)
-	return bucket, nil
+	log.Printf("Google Cloud Storage Bucket '%s' created for the project '%s' (location %s, storage class %s)\n", bucketName, b.gcpProjectID, location, storageClass)
+	return nil
 }
 
-// handleCreateGCStorageBucket handles the safe creation of a GCStorage from its name
-func (d *gcpVolDriver) handleCreateGCStorageBucket(volumeName string) (string, error) {
-	bucketName := d.getGCPBucketName(volumeName)
-	bucketExist, err := d.IsGCSBucketExist(bucketName)
+// isCreatedBucket returns true if a bucket conflicting with its creation was created since a time by the GCP project,
+// with the requested location & storage class
+func (b *gcsBackend) isCreatedBucket(bucketName string, since time.Time, location, storageClass string) bool {
+	info, err := b.StatBucket(bucketName)
+	if err != nil || info.Created.Before(since.Add(-gcsClockSkew)) {
+		return false
+	}
+	if checkBucketOptions(info, &bucketOptions{Location: location, StorageClass: storageClass}) != nil {
+		return false
+	}
+	// a bucket of another project is not listed in the GCP project
+	names, err := b.ListBuckets(bucketName)
 	if err != nil {
-		return "", err
+		return false
 	}
-	if !bucketExist {
-		_, err := d.createGCPStorageBucket(bucketName)
-		if err != nil {
-			return "", err
+	for _, name := range names {
+		if name == bucketName {
+			return true
 		}
 	}
-	return bucketName, nil
+	return false
 }
 
-// deleteStorageBucket deletes a bucket on GCStorage by its name
-func (d *gcpVolDriver) deleteStorageBucket(bucketName string) error {
-	if err := d.gcpClient.Delete(bucketName).Do(); err != nil {
+// isGCSError returns true if a GCStorage call failed with an HTTP status code
+func isGCSError(err error, code int) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == code
+}
+
+// DeleteBucket deletes a bucket on GCStorage by its name
+func (b *gcsBackend) DeleteBucket(bucketName string) error {
+	attempts := 0
+	err := b.retry.call("delete bucket", b.retry.MetadataTimeout, true, func(ctx context.Context) error {
+		attempts++
+		return b.buckets.Delete(bucketName).Context(ctx).Do()
+	})
+	if err != nil && attempts > 1 && isGCSError(err, http.StatusNotFound) {
+		// an attempt failing on the client side deleted the bucket
+		log.Printf("Google Cloud Storage Bucket '%s' was deleted by a previous attempt\n", bucketName)
+		err = nil
+	}
+	if err != nil {
 		return err
 	}
 	log.Printf("Google Cloud Storage Bucket '%s' deleted\n", bucketName)
 	return nil
 }
 
-// handleRemoveGCStorageBucket handles the safe deletion of a GCStorage by its name
-func (d *gcpVolDriver) handleRemoveGCStorageBucket(volumeName string) error {
-	bucketName := d.getGCPBucketName(volumeName)
-	bucketExist, err := d.IsGCSBucketExist(bucketName)
+// ListObjectVersions walks page by page all the generations of the objects stored in a GCStorage bucket under a prefix
+func (b *gcsBackend) ListObjectVersions(bucketName, prefix string, page func([]objectVersion) error) error {
+	query := &gcloudstorage.Query{Prefix: prefix, Versions: true}
+	for query != nil {
+		var list *gcloudstorage.ObjectList
+		err := b.retry.call("list objects", b.retry.ListTimeout, true, func(ctx context.Context) (err error) {
+			list, err = b.client.Bucket(bucketName).List(ctx, query)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		objects := make([]objectVersion, 0, len(list.Results))
+		for _, r := range list.Results {
+			objects = append(objects, objectVersion{
+				Name:    r.Name,
+				Version: strconv.FormatInt(r.Generation, 10),
+			})
+		}
+		if len(objects) > 0 {
+			if err := page(objects); err != nil {
+				return err
+			}
+		}
+		query = list.Next
+	}
+	return nil
+}
+
+// ListPrefixes returns the top level prefixes of a GCStorage bucket
+func (b *gcsBackend) ListPrefixes(bucketName string) ([]string, error) {
+	var prefixes []string
+	query := &gcloudstorage.Query{Delimiter: "/"}
+	for query != nil {
+		var list *gcloudstorage.ObjectList
+		err := b.retry.call("list prefixes", b.retry.ListTimeout, true, func(ctx context.Context) (err error) {
+			list, err = b.client.Bucket(bucketName).List(ctx, query)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, list.Prefixes...)
+		query = list.Next
+	}
+	return prefixes, nil
+}
+
+// GetObject reads an object from a GCStorage bucket
+func (b *gcsBackend) GetObject(bucketName, objectName string) ([]byte, error) {
+	var data []byte
+	err := b.retry.call("get object", b.retry.DataTimeout, true, func(ctx context.Context) error {
+		r, err := b.client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err = ioutil.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		if err == gcloudstorage.ErrObjectNotExist {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// PutObject writes an object into a GCStorage bucket, the write is not retried since it is not idempotent
+func (b *gcsBackend) PutObject(bucketName, objectName string, data []byte) error {
+	return b.retry.call("put object", b.retry.DataTimeout, false, func(ctx context.Context) error {
+		w := b.client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
+		if _, err := w.Write(data); err != nil {
+			w.CloseWithError(err)
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// DeleteObjectVersion permanently deletes a generation of an object from a GCStorage bucket
+func (b *gcsBackend) DeleteObjectVersion(bucketName string, o objectVersion) error {
+	obj := b.client.Bucket(bucketName).Object(o.Name)
+	// only the deletion of a given generation is idempotent
+	idempotent := o.Version != ""
+	if o.Version != "" {
+		generation, err := strconv.ParseInt(o.Version, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid generation %s of object %s: %s", o.Version, o.Name, err)
+		}
+		obj = obj.WithConditions(gcloudstorage.Generation(generation))
+	}
+	err := b.retry.call("delete object", b.retry.MetadataTimeout, idempotent, func(ctx context.Context) error {
+		return obj.Delete(ctx)
+	})
+	if err == gcloudstorage.ErrObjectNotExist {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// ListBuckets returns the names of the GCStorage buckets of the GCP project starting with a prefix
+func (b *gcsBackend) ListBuckets(prefix string) ([]string, error) {
+	var names []string
+	err := b.retry.call("list buckets", b.retry.ListTimeout, true, func(ctx context.Context) error {
+		names = nil
+		return b.buckets.List(b.gcpProjectID).Prefix(prefix).Pages(ctx, func(buckets *gstorage.Buckets) error {
+			for _, bucket := range buckets.Items {
+				names = append(names, bucket.Name)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// StatBucket returns the attributes of a GCStorage bucket
+func (b *gcsBackend) StatBucket(bucketName string) (*bucketInfo, error) {
+	var bucket *gstorage.Bucket
+	err := b.retry.call("get bucket", b.retry.MetadataTimeout, true, func(ctx context.Context) (err error) {
+		bucket, err = b.buckets.Get(bucketName).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, gcsBucketError(err)
+	}
+	labels, err := b.getBucketLabels(bucketName)
+	if err != nil {
+		return nil, gcsBucketError(err)
+	}
+	created, _ := time.Parse(time.RFC3339, bucket.TimeCreated)
+	return &bucketInfo{
+		Name:         bucket.Name,
+		Location:     bucket.Location,
+		StorageClass: bucket.StorageClass,
+		Created:      created,
+		Labels:       labels,
+	}, nil
+}
+
+// SetBucketLabels adds labels to a GCStorage bucket
+func (b *gcsBackend) SetBucketLabels(bucketName string, labels map[string]string) error {
+	body, err := json.Marshal(&gcsBucketLabels{Labels: labels})
 	if err != nil {
 		return err
 	}
-	if bucketExist && d.mountedBuckets[volumeName].cleanCloud {
-		// Empty the bucket
-		client, err := newGoogleCloudStorageClient(d.gcpServiceKeyPath)
+	// patching the same labels again leaves the bucket unchanged
+	err = b.retry.call("label bucket", b.retry.MetadataTimeout, true, func(ctx context.Context) error {
+		req, err := http.NewRequest("PATCH", gcsBucketsURL+url.PathEscape(bucketName)+"?fields=labels", bytes.NewReader(body))
 		if err != nil {
 			return err
 		}
-		if err := d.emptyGCSBucket(client, bucketName); err != nil {
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := ctxhttp.Do(ctx, b.httpClient, req)
+		if err != nil {
 			return err
 		}
-		// Delete the bucket on GCP Storage
-		if err := d.deleteStorageBucket(bucketName); err != nil {
+		defer googleapi.CloseBody(resp)
+		return googleapi.CheckResponse(resp)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Google Cloud Storage Bucket '%s' labeled: %v\n", bucketName, labels)
+	return nil
+}
+
+// getBucketLabels returns the labels of a GCStorage bucket
+func (b *gcsBackend) getBucketLabels(bucketName string) (map[string]string, error) {
+	var labels gcsBucketLabels
+	err := b.retry.call("get bucket labels", b.retry.MetadataTimeout, true, func(ctx context.Context) error {
+		resp, err := ctxhttp.Get(ctx, b.httpClient, gcsBucketsURL+url.PathEscape(bucketName)+"?fields=labels")
+		if err != nil {
+			return err
+		}
+		defer googleapi.CloseBody(resp)
+		if err := googleapi.CheckResponse(resp); err != nil {
 			return err
 		}
+		return json.NewDecoder(resp.Body).Decode(&labels)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return labels.Labels, nil
 }
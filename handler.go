@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// volumeDriverManifest is the plugin activation manifest of a volume driver
+const volumeDriverManifest = `{"Implements": ["VolumeDriver"]}`
+
+// volumeStatus is a volume returned by Get along with its status, which is not supported by volume.Volume
+type volumeStatus struct {
+	Name       string
+	Mountpoint string
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+// getResponse is the response of a Get request
+type getResponse struct {
+	Err    string
+	Volume *volumeStatus `json:",omitempty"`
+}
+
+// newVolumeHandler creates the HTTP handler of the Docker volume plugin API,
+// the Get requests return the status of the volumes in addition to volume.NewHandler
+func newVolumeHandler(d *gcpVolDriver) sdk.Handler {
+	h := sdk.NewHandler(volumeDriverManifest)
+	handle := func(path string, action func(volume.Request) volume.Response) {
+		h.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if !d.beginRequest() {
+				sdk.EncodeResponse(w, volume.Response{Err: errShuttingDown}, errShuttingDown)
+				return
+			}
+			defer d.endRequest()
+			var req volume.Request
+			if err := sdk.DecodeRequest(w, r, &req); err != nil {
+				return
+			}
+			res := action(req)
+			sdk.EncodeResponse(w, res, res.Err)
+		})
+	}
+	handle("/VolumeDriver.Create", d.Create)
+	handle("/VolumeDriver.List", d.List)
+	handle("/VolumeDriver.Remove", d.Remove)
+	handle("/VolumeDriver.Path", d.Path)
+	handle("/VolumeDriver.Mount", d.Mount)
+	handle("/VolumeDriver.Unmount", d.Unmount)
+	handle("/VolumeDriver.Capabilities", d.Capabilities)
+	h.HandleFunc("/VolumeDriver.Get", func(w http.ResponseWriter, r *http.Request) {
+		if !d.beginRequest() {
+			sdk.EncodeResponse(w, getResponse{Err: errShuttingDown}, errShuttingDown)
+			return
+		}
+		defer d.endRequest()
+		var req volume.Request
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := d.getWithStatus(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+	return h
+}
+
+// getWithStatus returns a volume along with its bucket, backend, prefix & bucket labels
+func (d *gcpVolDriver) getWithStatus(r volume.Request) getResponse {
+	v, ok, err := d.lookupVolume(r.Name)
+	if err != nil {
+		return getResponse{Err: err.Error()}
+	}
+	if !ok {
+		return getResponse{}
+	}
+	status := map[string]interface{}{
+		"bucket":  v.GcsBucketName,
+		"backend": v.backendType(),
+	}
+	if v.Prefix != "" {
+		status["prefix"] = v.Prefix
+	}
+	if len(v.Labels) > 0 {
+		status["labels"] = v.Labels
+	}
+	if len(v.GcsfuseOptions) > 0 {
+		status["gcsfuse_options"] = v.GcsfuseOptions
+	}
+	if d.fuse != nil {
+		if fuse, ok := d.fuse.status(d.getMountpoint(v.Volume.Name)); ok {
+			status["gcsfuse_restarts"] = fuse.Restarts
+			if fuse.LastExit != "" {
+				status["gcsfuse_last_exit"] = fuse.LastExit
+			}
+		}
+	}
+	return getResponse{
+		Volume: &volumeStatus{
+			Name:       v.Volume.Name,
+			Mountpoint: v.Volume.Mountpoint,
+			Status:     status,
+		},
+	}
+}
@@ -6,10 +6,25 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
+// volumeNameRegexp matches the volume names accepted by the Docker local volume driver
+var volumeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// validateVolumeName returns an error if a volume name cannot be used as a dir of the driver root dir:
+// a volume name never contains a path separator, and never starts with _ so it never conflicts with
+// the reserved dirs of the driver root dir (credentialsDirName, fuseLogsDirName)
+func validateVolumeName(name string) error {
+	if !volumeNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid volume name %s, a volume name must match %s", name, volumeNameRegexp)
+	}
+	return nil
+}
+
 // getVolumesFromHost looks up existing volumes defined in the volume driver root dir on the host
 func (d *gcpVolDriver) getVolumesFromHost() ([]string, error) {
 	var volumesNames []string
@@ -29,7 +44,7 @@ func (d *gcpVolDriver) getVolumesFromHost() ([]string, error) {
 				return nil, err
 			}
 			// a volume dir is defined by a path: volumeName/_data
-			if len(dataDir) == 1 && dataDir[0].Name() == "_data" {
+			if len(dataDir) == 1 && dataDir[0].Name() == "_data" && validateVolumeName(v.Name()) == nil {
 				volumesNames = append(volumesNames, v.Name())
 			}
 		}
@@ -48,19 +63,25 @@ func (d *gcpVolDriver) syncWithHost() error {
 	for _, v := range volumesNames {
 		log.Printf("Synchronizing: existing volume '%s' found\n", v)
 		// create a GCStorage bucket for that volume if not exist
-		bucketName, err := d.handleCreateGCStorageBucket(v)
+		bucketName, labels, err := d.handleCreateBucket(backendGCS, volumeIdentity{}, v, &bucketOptions{}, nil)
 		if err != nil {
 			return err
 		}
-		// add this volume to the driver's in-memory map of volumes
-		d.mountedBuckets[v] = &gcsVolumes{
-			volume: &volume.Volume{
+		vol := &gcsVolumes{
+			Volume: &volume.Volume{
 				Name:       v,
 				Mountpoint: filepath.Join(d.driverRootDir, v, "_data"),
 			},
-			gcsBucketName: bucketName,
-			cleanCloud:    true,
+			GcsBucketName: bucketName,
+			CleanCloud:    true,
+			CreatedAt:     time.Now().UTC(),
+		}
+		// the bucket of a volume dir was created by the driver, before the ownership labels were introduced
+		if err := d.migrateBucketLabels(vol, labels, nil); err != nil {
+			return err
 		}
+		// add this volume to the driver's in-memory map of volumes
+		d.mountedBuckets[v] = vol
 	}
 	return nil
 }
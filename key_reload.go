@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+)
+
+// reloadCredentials rebuilds the GCS clients from the current content of the GCP service key files,
+// the previous clients are kept if the new key is invalid:
+// the volumes mounted from now on use the new key, the gcsfuse processes already running keep the previous one until their next mount.
+// There is no idle gcsfuse mount to remount with the new key: a bucket is mounted by the first active mount of its volume
+// & unmounted by the last one, & the FUSE mounts without any active mount are unmounted at startup
+func (d *gcpVolDriver) reloadCredentials() error {
+	if d.newGcsBackend == nil {
+		return fmt.Errorf("The GCP credentials cannot be reloaded")
+	}
+	if d.gcpServiceKeyPath != "" {
+		key, err := loadServiceAccountKey(d.gcpServiceKeyPath)
+		if err != nil {
+			return err
+		}
+		// the bucket names are derived from the project
+		if key.ProjectID != d.gcpProjectID {
+			return fmt.Errorf("GCP service account key %s belongs to the project '%s' instead of '%s'", d.gcpServiceKeyPath, key.ProjectID, d.gcpProjectID)
+		}
+	}
+	if d.identities != nil {
+		for name, keyPath := range d.identities.credentials {
+			if _, err := loadServiceAccountKey(keyPath); err != nil {
+				return fmt.Errorf("Credentials %s: %s", name, err)
+			}
+		}
+	}
+	b, err := d.newGcsBackend()
+	if err != nil {
+		return err
+	}
+	d.backendsMu.Lock()
+	d.backends[backendGCS] = b
+	d.backendsMu.Unlock()
+	if d.identities != nil {
+		d.identities.reset()
+	}
+	log.Println("GCP credentials reloaded")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var mounted []string
+	for name, v := range d.mountedBuckets {
+		if v.backendType() == backendGCS && len(v.Mounts) > 0 {
+			mounted = append(mounted, name)
+		}
+	}
+	if len(mounted) > 0 {
+		sort.Strings(mounted)
+		log.Printf("GCP credentials reloaded: volume(s) %v in use keep the previous key until they are mounted again\n", mounted)
+	}
+	return nil
+}
+
+// keyWatcher polls GCP service key files & calls onChange when the content of one of them changes
+type keyWatcher struct {
+	paths    []string
+	interval time.Duration
+	onChange func()
+	sums     map[string][sha256.Size]byte
+}
+
+// newKeyWatcher creates a watcher of GCP service key files, the current content of the files is the reference
+func newKeyWatcher(paths []string, interval time.Duration, onChange func()) *keyWatcher {
+	w := &keyWatcher{
+		paths:    paths,
+		interval: interval,
+		onChange: onChange,
+		sums:     make(map[string][sha256.Size]byte),
+	}
+	w.changed()
+	return w
+}
+
+// changed returns true if the content of a key file changed since the previous call,
+// an unreadable key file is ignored as it may be in the middle of its replacement
+func (w *keyWatcher) changed() bool {
+	changed := false
+	for _, path := range w.paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if prev, ok := w.sums[path]; ok && prev != sum {
+			log.Printf("GCP service key file %s changed\n", path)
+			changed = true
+		}
+		w.sums[path] = sum
+	}
+	return changed
+}
+
+// run polls the key files forever
+func (w *keyWatcher) run() {
+	for range time.Tick(w.interval) {
+		if w.changed() {
+			w.onChange()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyWatcherChanged(t *testing.T) {
+	path := writeTestKeyFile(t, testKeyFields("", nil))
+	w := newKeyWatcher([]string{path}, time.Hour, func() {})
+	if w.changed() {
+		t.Error("unchanged key file reported as changed")
+	}
+	// the same content written again is not a change
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w.changed() {
+		t.Error("key file rewritten with the same content reported as changed")
+	}
+	// the key file is unreadable in the middle of its replacement
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if w.changed() {
+		t.Error("key file being replaced reported as changed")
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"type": "service_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !w.changed() {
+		t.Error("replaced key file not reported as changed")
+	}
+	if w.changed() {
+		t.Error("key file change reported twice")
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	d, _, _ := newTestDriver(t)
+	if err := d.reloadCredentials(); err == nil {
+		t.Fatal("credentials reloaded without a way to build the GCS backend")
+	}
+	initial := d.backends[backendGCS]
+	var reloaded *volumeBackend
+	var backendErr error
+	d.newGcsBackend = func() (*volumeBackend, error) {
+		if backendErr != nil {
+			return nil, backendErr
+		}
+		reloaded = &volumeBackend{buckets: newMemoryBackend(), mounter: newDirMounter(), bucketPrefix: testProjectID}
+		return reloaded, nil
+	}
+	// the previous backend is kept when the new key or the new backend is invalid
+	tests := []struct {
+		keyPath    string
+		backendErr error
+		err        string
+	}{
+		{writeTestKeyFile(t, testKeyFields("private_key", nil)), nil, "has no private_key"},
+		{writeTestKeyFile(t, testKeyFields("", map[string]string{"project_id": "other-project"})), nil, "belongs to the project 'other-project' instead of 'test-project'"},
+		{writeTestKeyFile(t, testKeyFields("", nil)), fmt.Errorf("GCP credentials rejected"), "GCP credentials rejected"},
+	}
+	for _, test := range tests {
+		d.gcpServiceKeyPath = test.keyPath
+		backendErr = test.backendErr
+		if err := d.reloadCredentials(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("reloading the key %s: error %v, expected %s", test.keyPath, err, test.err)
+		}
+		if d.backends[backendGCS] != initial {
+			t.Errorf("GCS backend replaced by the invalid key %s", test.keyPath)
+		}
+	}
+	backendErr = nil
+	if err := d.reloadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if d.backends[backendGCS] != reloaded {
+		t.Error("GCS backend not replaced by the valid key")
+	}
+}
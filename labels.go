@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// labelOwner is the bucket label marking the buckets created by the driver
+	labelOwner = "docker-volume-driver"
+	// labelVolume is the bucket label holding the volume name
+	labelVolume = "docker-volume"
+	// labelHost is the bucket label holding the host which created the bucket
+	labelHost = "docker-host"
+	// labelCreatedAt is the bucket label holding the bucket creation time as a unix timestamp
+	labelCreatedAt = "created-at"
+	// labelOptionPrefix prefixes the volume options defining user labels: label.key=value
+	labelOptionPrefix = "label."
+)
+
+var (
+	// labelKeyRegexp matches the label keys accepted by GCS
+	labelKeyRegexp = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	// labelValueRegexp matches the label values accepted by GCS
+	labelValueRegexp = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+	// labelInvalidCharsRegexp matches the characters not accepted in a label value
+	labelInvalidCharsRegexp = regexp.MustCompile(`[^a-z0-9_-]`)
+)
+
+// parseUserLabels returns the user labels defined by the volume options label.key=value
+func parseUserLabels(options map[string]string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for opt, value := range options {
+		if !strings.HasPrefix(opt, labelOptionPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(opt, labelOptionPrefix)
+		if !labelKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("Invalid label key %s, label keys must match %s", key, labelKeyRegexp)
+		}
+		if isReservedLabel(key) {
+			return nil, fmt.Errorf("Label %s is reserved by the driver", key)
+		}
+		if !labelValueRegexp.MatchString(value) {
+			return nil, fmt.Errorf("Invalid value %s of label %s, label values must match %s", value, key, labelValueRegexp)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// isReservedLabel returns true if a label key is set by the driver
+func isReservedLabel(key string) bool {
+	switch key {
+	case labelOwner, labelVolume, labelHost, labelCreatedAt:
+		return true
+	}
+	return false
+}
+
+// sanitizeLabelValue turns a string into a valid label value
+func sanitizeLabelValue(value string) string {
+	value = labelInvalidCharsRegexp.ReplaceAllString(strings.ToLower(value), "_")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return value
+}
+
+// getBucketLabels returns the labels of the bucket created for a volume:
+// the driver ownership labels & the user labels
+func getBucketLabels(volumeName string, userLabels map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range userLabels {
+		labels[k] = v
+	}
+	hostname, _ := os.Hostname()
+	labels[labelOwner] = sanitizeLabelValue(driverID)
+	labels[labelVolume] = sanitizeLabelValue(volumeName)
+	labels[labelHost] = sanitizeLabelValue(hostname)
+	labels[labelCreatedAt] = strconv.FormatInt(time.Now().Unix(), 10)
+	return labels
+}
+
+// isDriverOwned returns true if bucket labels carry the ownership label of the driver
+func isDriverOwned(labels map[string]string) bool {
+	return labels[labelOwner] == sanitizeLabelValue(driverID)
+}
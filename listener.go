@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-connections/sockets"
+)
+
+const (
+	// pluginSockDir is the dir where docker discovers the plugin unix sockets without a spec file
+	pluginSockDir = "/run/docker/plugins"
+	// pluginSpecDir is the dir where docker discovers the plugin spec files
+	pluginSpecDir = "/etc/docker/plugins"
+)
+
+// listenerConfig defines the address the driver listens on & how docker discovers it
+type listenerConfig struct {
+	// Address is unix:///path/to.sock or tcp://host:port
+	Address string
+	// SocketGroup is the group owning the unix socket
+	SocketGroup string
+	// TLS server certificate & key of a tcp listener, TLS is disabled if empty
+	TLSCert string
+	TLSKey  string
+	// TLSCA verifies the client certificates of a tcp listener, not verified if empty
+	TLSCA string
+	// SpecDir receives the spec file of the driver, no spec file is written if empty
+	SpecDir string
+	// SpecAddress is the address written to the spec file, the listened address if empty
+	SpecAddress string
+	// SpecTLSCA, SpecTLSCert & SpecTLSKey are the TLS files used by the docker daemon, written to the spec file
+	SpecTLSCA   string
+	SpecTLSCert string
+	SpecTLSKey  string
+}
+
+// pluginSpec is the JSON spec file of a plugin, read by the docker daemon
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *pluginSpecTLS `json:",omitempty"`
+}
+
+// pluginSpecTLS is the TLS config of the docker daemon connecting to a plugin
+type pluginSpecTLS struct {
+	InsecureSkipVerify bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+}
+
+// parseListenAddress splits a listen address into its protocol & address
+func parseListenAddress(address string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid listen address %s: %s", address, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return "", "", fmt.Errorf("Invalid listen address %s, expected unix:///path/to.sock", address)
+		}
+		return "unix", path, nil
+	case "tcp":
+		if u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return "", "", fmt.Errorf("Invalid listen address %s, expected tcp://host:port", address)
+		}
+		return "tcp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("Invalid listen address %s, the supported protocols are unix:// & tcp://", address)
+}
+
+// newDriverListener creates the listener of the driver & writes its spec file,
+// it returns the path of the spec file, empty if none is written
+func newDriverListener(conf *listenerConfig) (net.Listener, string, error) {
+	proto, addr, err := parseListenAddress(conf.Address)
+	if err != nil {
+		return nil, "", err
+	}
+	if proto == "unix" {
+		if conf.TLSCert != "" || conf.TLSCA != "" {
+			return nil, "", fmt.Errorf("TLS is only supported by tcp:// listen addresses")
+		}
+		if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
+			return nil, "", err
+		}
+		l, err := newUnixListener(addr, conf.SocketGroup)
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("Listening on unix socket %s...\n", addr)
+		// docker discovers the sockets of its plugin dir by itself
+		if conf.SpecDir == "" || filepath.Dir(addr) == pluginSockDir {
+			return l, "", nil
+		}
+		spec, err := writeTextSpec(conf.SpecDir, "unix://"+addr)
+		if err != nil {
+			l.Close()
+			return nil, "", err
+		}
+		return l, spec, nil
+	}
+
+	tlsConfig, err := newServerTLSConfig(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	l, err := sockets.NewTCPSocket(addr, tlsConfig)
+	if err != nil {
+		return nil, "", err
+	}
+	if tlsConfig == nil {
+		log.Printf("TCP server listening on %s...\n", l.Addr())
+	} else {
+		log.Printf("TLS server listening on %s, client certificates verified: %t\n", l.Addr(), conf.TLSCA != "")
+	}
+	if conf.SpecDir == "" {
+		return l, "", nil
+	}
+	specAddr := conf.SpecAddress
+	if specAddr == "" {
+		specAddr = l.Addr().String()
+	}
+	var spec string
+	if tlsConfig == nil {
+		spec, err = writeTextSpec(conf.SpecDir, "tcp://"+specAddr)
+	} else {
+		spec, err = writeJSONSpec(conf.SpecDir, &pluginSpec{
+			Name: driverID,
+			Addr: "https://" + specAddr,
+			TLSConfig: &pluginSpecTLS{
+				CAFile:   conf.SpecTLSCA,
+				CertFile: conf.SpecTLSCert,
+				KeyFile:  conf.SpecTLSKey,
+			},
+		})
+	}
+	if err != nil {
+		l.Close()
+		return nil, "", err
+	}
+	return l, spec, nil
+}
+
+// newServerTLSConfig returns the TLS config of a tcp listener, nil if TLS is disabled
+func newServerTLSConfig(conf *listenerConfig) (*tls.Config, error) {
+	if conf.TLSCert == "" && conf.TLSKey == "" {
+		if conf.TLSCA != "" {
+			return nil, fmt.Errorf("Verifying the client certificates requires a TLS server certificate & key")
+		}
+		return nil, nil
+	}
+	if conf.TLSCert == "" || conf.TLSKey == "" {
+		return nil, fmt.Errorf("TLS requires both a server certificate & key")
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("Loading the TLS server certificate failed: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.TLSCA != "" {
+		pem, err := ioutil.ReadFile(conf.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No CA certificate found in %s", conf.TLSCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// writeTextSpec writes the .spec file of the driver holding its URL
+func writeTextSpec(specDir, address string) (string, error) {
+	return writeSpecFile(filepath.Join(specDir, driverID+".spec"), []byte(address))
+}
+
+// writeJSONSpec writes the .json spec file of the driver, holding the TLS config of the docker daemon
+func writeJSONSpec(specDir string, spec *pluginSpec) (string, error) {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return writeSpecFile(filepath.Join(specDir, driverID+".json"), data)
+}
+
+// writeSpecFile writes a spec file of the driver, removing the spec file of the other format
+// since docker reads the .spec file before the .json one
+func writeSpecFile(path string, data []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	for _, ext := range []string{".spec", ".json"} {
+		other := strings.TrimSuffix(path, filepath.Ext(path)) + ext
+		if other != path {
+			if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	log.Printf("Plugin spec file written to %s\n", path)
+	return path, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate & its key, the certificate is also its CA
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		proto   string
+		addr    string
+		err     string
+	}{
+		{"unix:///run/docker/plugins/gcs.sock", "unix", "/run/docker/plugins/gcs.sock", ""},
+		{"unix://gcs.sock", "", "", "Invalid listen address unix://gcs.sock, expected unix:///path/to.sock"},
+		{"unix:", "", "", "Invalid listen address unix:, expected unix:///path/to.sock"},
+		{"tcp://127.0.0.1:8080", "tcp", "127.0.0.1:8080", ""},
+		{"tcp://:8080/", "tcp", ":8080", ""},
+		{"tcp://127.0.0.1:8080/plugin", "", "", "Invalid listen address tcp://127.0.0.1:8080/plugin, expected tcp://host:port"},
+		{"tcp://", "", "", "Invalid listen address tcp://, expected tcp://host:port"},
+		{"http://127.0.0.1:8080", "", "", "Invalid listen address http://127.0.0.1:8080, the supported protocols are unix:// & tcp://"},
+		{"/run/docker/plugins/gcs.sock", "", "", "Invalid listen address /run/docker/plugins/gcs.sock, the supported protocols are unix:// & tcp://"},
+	}
+	for _, test := range tests {
+		proto, addr, err := parseListenAddress(test.address)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseListenAddress(%s): error %v, expected %s", test.address, err, test.err)
+			}
+			continue
+		}
+		if err != nil || proto != test.proto || addr != test.addr {
+			t.Errorf("parseListenAddress(%s) = %s, %s, %v, expected %s, %s", test.address, proto, addr, err, test.proto, test.addr)
+		}
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	cert, key := writeTestCertificate(t)
+	tests := []struct {
+		conf       listenerConfig
+		clientAuth tls.ClientAuthType
+		err        string
+	}{
+		{listenerConfig{TLSCA: cert}, 0, "Verifying the client certificates requires a TLS server certificate & key"},
+		{listenerConfig{TLSCert: cert}, 0, "TLS requires both a server certificate & key"},
+		{listenerConfig{TLSCert: cert, TLSKey: key, TLSCA: key}, 0, "No CA certificate found in " + key},
+		{listenerConfig{TLSCert: cert, TLSKey: key}, tls.NoClientCert, ""},
+		// a client certificate is required & verified as soon as a CA is given
+		{listenerConfig{TLSCert: cert, TLSKey: key, TLSCA: cert}, tls.RequireAndVerifyClientCert, ""},
+	}
+	for _, test := range tests {
+		tlsConfig, err := newServerTLSConfig(&test.conf)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("newServerTLSConfig(%+v): error %v, expected %s", test.conf, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlsConfig.ClientAuth != test.clientAuth || (test.conf.TLSCA != "") != (tlsConfig.ClientCAs != nil) {
+			t.Errorf("newServerTLSConfig(%+v): client auth %s, expected %s", test.conf, tlsConfig.ClientAuth, test.clientAuth)
+		}
+	}
+	if tlsConfig, err := newServerTLSConfig(&listenerConfig{}); err != nil || tlsConfig != nil {
+		t.Errorf("TLS enabled without certificate: %v", err)
+	}
+}
+
+func TestDriverListenerSpecFile(t *testing.T) {
+	cert, key := writeTestCertificate(t)
+	specDir := t.TempDir()
+	textSpec := filepath.Join(specDir, driverID+".spec")
+	jsonSpec := filepath.Join(specDir, driverID+".json")
+
+	// the .spec file holds the listened address
+	l, spec, err := newDriverListener(&listenerConfig{Address: "tcp://127.0.0.1:0", SpecDir: specDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if data, err := ioutil.ReadFile(spec); spec != textSpec || err != nil || string(data) != "tcp://"+l.Addr().String() {
+		t.Errorf("spec file %s: %q, %v", spec, data, err)
+	}
+
+	// the .json spec file holds the -spec-address & the TLS files of the docker daemon, it replaces the .spec file
+	l, spec, err = newDriverListener(&listenerConfig{
+		Address:     "tcp://127.0.0.1:0",
+		TLSCert:     cert,
+		TLSKey:      key,
+		TLSCA:       cert,
+		SpecDir:     specDir,
+		SpecAddress: "plugins.example.com:8443",
+		SpecTLSCA:   "/etc/docker/plugins/ca.pem",
+		SpecTLSCert: "/etc/docker/plugins/cert.pem",
+		SpecTLSKey:  "/etc/docker/plugins/key.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if spec != jsonSpec {
+		t.Errorf("spec file %s, expected %s", spec, jsonSpec)
+	}
+	if _, err := os.Stat(textSpec); !os.IsNotExist(err) {
+		t.Errorf("the .spec file read first by docker is left behind: %v", err)
+	}
+	data, err := ioutil.ReadFile(jsonSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written pluginSpec
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	expected := pluginSpec{
+		Name: driverID,
+		Addr: "https://plugins.example.com:8443",
+		TLSConfig: &pluginSpecTLS{
+			CAFile:   "/etc/docker/plugins/ca.pem",
+			CertFile: "/etc/docker/plugins/cert.pem",
+			KeyFile:  "/etc/docker/plugins/key.pem",
+		},
+	}
+	if written.Name != expected.Name || written.Addr != expected.Addr || written.TLSConfig == nil || *written.TLSConfig != *expected.TLSConfig {
+		t.Errorf("spec file content %s", data)
+	}
+
+	// the -spec-address also overrides the address of a .spec file, which replaces the .json file
+	l, spec, err = newDriverListener(&listenerConfig{Address: "tcp://127.0.0.1:0", SpecDir: specDir, SpecAddress: "plugins.example.com:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if data, err := ioutil.ReadFile(spec); spec != textSpec || err != nil || string(data) != "tcp://plugins.example.com:8080" {
+		t.Errorf("spec file %s: %q, %v", spec, data, err)
+	}
+	if _, err := os.Stat(jsonSpec); !os.IsNotExist(err) {
+		t.Errorf("the previous .json spec file is left behind: %v", err)
+	}
+
+	// a unix socket out of the plugin dir of docker is discovered through a .spec file
+	sock := filepath.Join(t.TempDir(), "gcs.sock")
+	l, spec, err = newDriverListener(&listenerConfig{Address: "unix://" + sock, SpecDir: specDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if data, err := ioutil.ReadFile(spec); spec != textSpec || err != nil || string(data) != "unix://"+sock {
+		t.Errorf("spec file %s: %q, %v", spec, data, err)
+	}
+}
+
+func TestServeDriverRemovesSpecFile(t *testing.T) {
+	d, _, _ := newTestDriver(t)
+	specDir := t.TempDir()
+	spec := filepath.Join(specDir, driverID+".spec")
+	served := make(chan error, 1)
+	go func() {
+		served <- serveDriver(d, &listenerConfig{Address: "tcp://127.0.0.1:0", SpecDir: specDir})
+	}()
+	// the signals are handled by serveDriver once the spec file is written
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(spec); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spec file not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("driver still served after SIGTERM")
+	}
+	if _, err := os.Stat(spec); !os.IsNotExist(err) {
+		t.Errorf("spec file left behind: %v", err)
+	}
+
+}
@@ -0,0 +1,15 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package main
+
+import (
+	"net"
+
+	"github.com/docker/go-connections/sockets"
+)
+
+// newUnixListener creates a unix socket owned by a group
+func newUnixListener(path, group string) (net.Listener, error) {
+	return sockets.NewUnixSocket(path, group)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !freebsd
+// +build !linux,!freebsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// newUnixListener fails, unix socket creation is only supported on linux & freebsd
+func newUnixListener(path, group string) (net.Listener, error) {
+	return nil, fmt.Errorf("Unix socket creation is only supported on linux and freebsd, use a tcp:// listen address")
+}
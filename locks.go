@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// volumeLocker serializes the requests targeting the same volume name
+type volumeLocker struct {
+	mu    sync.Mutex
+	locks map[string]*volumeLock
+}
+
+// volumeLock is a mutex shared by all the requests currently targeting a volume name
+type volumeLock struct {
+	sync.Mutex
+	refs int
+}
+
+// newVolumeLocker creates an empty volume locker
+func newVolumeLocker() *volumeLocker {
+	return &volumeLocker{
+		locks: make(map[string]*volumeLock),
+	}
+}
+
+// lock locks a volume name & returns the function unlocking it
+func (l *volumeLocker) lock(name string) func() {
+	l.mu.Lock()
+	vl, ok := l.locks[name]
+	if !ok {
+		vl = &volumeLock{}
+		l.locks[name] = vl
+	}
+	vl.refs++
+	l.mu.Unlock()
+
+	vl.Lock()
+	return func() {
+		vl.Unlock()
+		l.mu.Lock()
+		vl.refs--
+		if vl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
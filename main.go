@@ -5,18 +5,86 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
-const (
-	driverID      = "gcstorage"
-	driverTCPPort = "localhost:8080"
+const driverID = "gcstorage"
+
+// credentialsFlag registers GCP service key files by name: -credentials name=key.json, repeatable
+type credentialsFlag map[string]string
+
+func (c credentialsFlag) String() string {
+	var creds []string
+	for name, path := range c {
+		creds = append(creds, name+"="+path)
+	}
+	return strings.Join(creds, ",")
+}
+
+func (c credentialsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid credentials %s, expected name=key.json", value)
+	}
+	path, err := filepath.Abs(parts[1])
+	if err != nil {
+		return err
+	}
+	c[parts[0]] = path
+	return nil
+}
+
+var gcpCredentials = make(credentialsFlag)
+
+func init() {
+	flag.Var(gcpCredentials, "credentials", "GCP service account key selected per volume by name with the volume option credentials=name: name=key.json, repeatable")
+}
+
+var (
+	serviceKeyPath      = flag.String("gcp-key-json", os.Getenv("GCP_KEY_JSON"), "Google Cloud Platform Service Account Key as JSON, the Application Default Credentials are used if not defined, defaults to $GCP_KEY_JSON")
+	gcpProject          = flag.String("project", os.Getenv("GCP_PROJECT"), "GCP project of the buckets when there is no service account key, defaults to $GCP_PROJECT or to the project of the GCE metadata server")
+	defaultLocation     = flag.String("default-location", envOr("DEFAULT_LOCATION", "US"), "Default location of the GCS buckets, overridden by the volume option location ($DEFAULT_LOCATION)")
+	defaultStorageClass = flag.String("default-storage-class", envOr("DEFAULT_STORAGE_CLASS", "STANDARD"), "Default storage class of the GCS buckets (STANDARD, NEARLINE, COLDLINE, ARCHIVE, REGIONAL), overridden by the volume option storage_class ($DEFAULT_STORAGE_CLASS)")
+	gcsMaxAttempts      = flag.Int("gcs-max-attempts", defaultGcsRetryPolicy.MaxAttempts, "Maximum number of attempts of the idempotent GCS calls failing with a transient error")
+	gcsMetadataTimeout  = flag.Duration("gcs-metadata-timeout", defaultGcsRetryPolicy.MetadataTimeout, "Deadline of each attempt of a GCS bucket or object metadata call")
+	gcsListTimeout      = flag.Duration("gcs-list-timeout", defaultGcsRetryPolicy.ListTimeout, "Deadline of each attempt of a GCS listing call, per page")
+	gcsDataTimeout      = flag.Duration("gcs-data-timeout", defaultGcsRetryPolicy.DataTimeout, "Deadline of each attempt of a GCS object read or write")
+	keyWatchInterval    = flag.Duration("key-watch-interval", 30*time.Second, "Interval between the checks of the GCP service key files, a changed key is reloaded (as on SIGHUP), 0 disables the checks")
+	sharedBucket        = flag.String("shared-bucket", os.Getenv("SHARED_BUCKET"), "Existing GCS bucket holding every GCS volume as a prefix, instead of a bucket per volume ($SHARED_BUCKET)")
+	s3Endpoint          = flag.String("s3-endpoint", os.Getenv("S3_ENDPOINT"), "S3 compatible endpoint URL enabling the s3 volume backend (e.g. https://s3.amazonaws.com, http://localhost:9000 for MinIO) ($S3_ENDPOINT)")
+	s3Region            = flag.String("s3-region", envOr("S3_REGION", s3DefaultRegion), "S3 region of the buckets ($S3_REGION)")
+	s3AccessKey         = flag.String("s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key, defaults to $AWS_ACCESS_KEY_ID")
+	s3SecretKey         = flag.String("s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 secret key, defaults to $AWS_SECRET_ACCESS_KEY")
+	s3BucketPrefix      = flag.String("s3-bucket-prefix", envOr("S3_BUCKET_PREFIX", "docker-volume"), "Prefix of the S3 bucket names: prefix-volumeName ($S3_BUCKET_PREFIX)")
+	s3Fuse              = flag.String("s3-fuse", envOr("S3_FUSE", s3FuseS3fs), "FUSE tool mounting the S3 buckets: s3fs or goofys ($S3_FUSE)")
+	listenAddress       = flag.String("listen", "unix://"+filepath.Join(pluginSockDir, driverID+".sock"), "Address the driver listens on: unix:///path/to.sock or tcp://host:port")
+	socketGroup         = flag.String("socket-group", "root", "Group owning the unix socket of the driver")
+	tlsCert             = flag.String("tls-cert", "", "TLS server certificate of a tcp:// listen address, enables TLS")
+	tlsKey              = flag.String("tls-key", "", "TLS server key of a tcp:// listen address")
+	tlsCA               = flag.String("tls-ca", "", "CA certificate verifying the client certificates of the docker daemon, requires -tls-cert")
+	specDir             = flag.String("spec-dir", pluginSpecDir, "Dir receiving the spec file of the driver discovered by the docker daemon, disabled if empty")
+	specAddress         = flag.String("spec-address", "", "host:port of a tcp:// listen address written to the spec file, defaults to the listened address")
+	specTLSCA           = flag.String("spec-tls-ca", "", "CA certificate verifying the driver TLS certificate, written to the spec file for the docker daemon")
+	specTLSCert         = flag.String("spec-tls-cert", "", "Client certificate of the docker daemon, written to the spec file")
+	specTLSKey          = flag.String("spec-tls-key", "", "Client key of the docker daemon, written to the spec file")
+	shutdownTimeout     = flag.Duration("shutdown-timeout", 30*time.Second, "Maximum delay to drain the in-flight Docker requests on SIGTERM or SIGINT")
+	shutdownUnmount     = flag.Bool("shutdown-unmount", false, "Unmount the FUSE mounts not in use by a container on SIGTERM or SIGINT, the volumes in use by a container always stay mounted for the next driver process")
 )
 
-var serviceKeyPath = flag.String("gcp-key-json", "", "Google Cloud Platform Service Account Key as JSON")
+// envOr returns the value of an environment variable, or a default value if it is not defined,
+// the environment variables are the settings of the managed plugin
+func envOr(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
 
 func main() {
 	// define CLI & get args
@@ -25,34 +93,132 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	if len(*serviceKeyPath) == 0 {
+	if flag.NArg() > 0 {
 		Usage()
 		os.Exit(1)
 	}
 
 	// define volume driver
 	defaultPath := filepath.Join(volume.DefaultDockerRootDirectory, driverID)
-	gcpServiceKeyAbsPath, err := filepath.Abs(*serviceKeyPath)
+	var gcpServiceKeyAbsPath string
+	if len(*serviceKeyPath) > 0 {
+		var err error
+		gcpServiceKeyAbsPath, err = filepath.Abs(*serviceKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var s3Conf *s3Config
+	if len(*s3Endpoint) > 0 {
+		s3Conf = &s3Config{
+			Endpoint:     *s3Endpoint,
+			Region:       *s3Region,
+			AccessKey:    *s3AccessKey,
+			SecretKey:    *s3SecretKey,
+			BucketPrefix: *s3BucketPrefix,
+			FuseTool:     *s3Fuse,
+		}
+	}
+	gcsDefaults := &bucketOptions{
+		Location:     *defaultLocation,
+		StorageClass: strings.ToUpper(*defaultStorageClass),
+	}
+	gcsRetry := defaultGcsRetryPolicy
+	gcsRetry.MaxAttempts = *gcsMaxAttempts
+	gcsRetry.MetadataTimeout = *gcsMetadataTimeout
+	gcsRetry.ListTimeout = *gcsListTimeout
+	gcsRetry.DataTimeout = *gcsDataTimeout
+	if gcsRetry.MaxAttempts < 1 {
+		log.Fatal("-gcs-max-attempts must be at least 1")
+	}
+	volDriver, err := newGcpVolDriver(&driverConfig{
+		RootDir:           defaultPath,
+		GcpServiceKeyPath: gcpServiceKeyAbsPath,
+		GcpProjectID:      *gcpProject,
+		GcpCredentials:    gcpCredentials,
+		GcsDefaults:       gcsDefaults,
+		GcsRetry:          &gcsRetry,
+		GcsSharedBucket:   *sharedBucket,
+		S3:                s3Conf,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	volDriver, err := newGcpVolDriver(defaultPath, gcpServiceKeyAbsPath)
+
+	// reload the GCP credentials on SIGHUP & when a service key file changes
+	reloadCredentials := func() {
+		if err := volDriver.reloadCredentials(); err != nil {
+			log.Printf("Reloading the GCP credentials failed, the previous credentials are kept: %s\n", err)
+		}
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Println("SIGHUP received, reloading the GCP credentials")
+			reloadCredentials()
+		}
+	}()
+	var keyPaths []string
+	if len(gcpServiceKeyAbsPath) > 0 {
+		keyPaths = append(keyPaths, gcpServiceKeyAbsPath)
+	}
+	for _, path := range gcpCredentials {
+		keyPaths = append(keyPaths, path)
+	}
+	if *keyWatchInterval > 0 && len(keyPaths) > 0 {
+		go newKeyWatcher(keyPaths, *keyWatchInterval, reloadCredentials).run()
+	}
+
+	err = serveDriver(volDriver, &listenerConfig{
+		Address:     *listenAddress,
+		SocketGroup: *socketGroup,
+		TLSCert:     *tlsCert,
+		TLSKey:      *tlsKey,
+		TLSCA:       *tlsCA,
+		SpecDir:     *specDir,
+		SpecAddress: *specAddress,
+		SpecTLSCA:   *specTLSCA,
+		SpecTLSCert: *specTLSCert,
+		SpecTLSKey:  *specTLSKey,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+// serveDriver serves the volume driver until SIGTERM or SIGINT, the spec file is removed
+// before returning so that log.Fatal in the caller does not leave it behind
+func serveDriver(volDriver *gcpVolDriver, conf *listenerConfig) error {
+	// shut down gracefully on SIGTERM & SIGINT, also received while the listener is created
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stop)
 
 	// create volume handler
-	volHandler := volume.NewHandler(volDriver)
+	volHandler := newVolumeHandler(volDriver)
 
 	// start HTTP server
-	if runtime.GOOS == "linux" {
-		log.Printf("Listening on unix socket /run/docker/plugins/%s.sock...\n", driverID)
-		log.Println(volHandler.ServeUnix("root", driverID))
-	}
-	if runtime.GOOS == "darwin" { // MacOS
-		log.Fatal("unix socket creation is only supported on linux and freebsd")
-		//TODO
-		// log.Printf("TCP server listening on port %s...\n", driverTCPPort)
-		// log.Println(volHandler.ServeTCP(driverID, driverTCPPort))
+	listener, spec, err := newDriverListener(conf)
+	if err != nil {
+		return err
+	}
+	if spec != "" {
+		defer os.Remove(spec)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- volHandler.Serve(listener)
+	}()
+
+	select {
+	case sig := <-stop:
+		log.Printf("%s received, shutting down\n", sig)
+		// closing the listener also removes the unix socket
+		listener.Close()
+		volDriver.shutdown(*shutdownTimeout, *shutdownUnmount)
+		return nil
+	case err := <-served:
+		return err
 	}
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryPageSize is the number of objects per page listed by a memoryBackend
+const memoryPageSize = 1000
+
+// memoryBackend is an in-memory implementation of BucketBackend,
+// used to run the driver without any cloud object storage
+type memoryBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+// memoryBucket is a bucket of a memoryBackend
+type memoryBucket struct {
+	created time.Time
+	opts    bucketOptions
+	labels  map[string]string
+	objects map[string][]byte
+}
+
+// newMemoryBackend creates an empty in-memory backend
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+// BucketExists returns true if a bucket exists in memory
+func (b *memoryBackend) BucketExists(bucketName string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.buckets[bucketName]
+	return ok, nil
+}
+
+// CreateBucket creates an empty bucket in memory
+func (b *memoryBackend) CreateBucket(bucketName string, opts *bucketOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.buckets[bucketName]; ok {
+		return fmt.Errorf("bucket %s already exists", bucketName)
+	}
+	b.buckets[bucketName] = &memoryBucket{
+		created: time.Now().UTC(),
+		opts:    *opts,
+		labels:  make(map[string]string),
+		objects: make(map[string][]byte),
+	}
+	return nil
+}
+
+// DeleteBucket deletes an empty bucket from memory
+func (b *memoryBackend) DeleteBucket(bucketName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return errBucketNotFound
+	}
+	if len(bucket.objects) > 0 {
+		return fmt.Errorf("bucket %s is not empty", bucketName)
+	}
+	delete(b.buckets, bucketName)
+	return nil
+}
+
+// ListObjectVersions walks the objects of a bucket under a prefix in sorted pages of memoryPageSize objects,
+// the objects have a single version
+func (b *memoryBackend) ListObjectVersions(bucketName, prefix string, page func([]objectVersion) error) error {
+	b.mu.Lock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		b.mu.Unlock()
+		return errBucketNotFound
+	}
+	var objects []objectVersion
+	for name := range bucket.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, objectVersion{Name: name})
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	for len(objects) > 0 {
+		n := memoryPageSize
+		if len(objects) < n {
+			n = len(objects)
+		}
+		if err := page(objects[:n]); err != nil {
+			return err
+		}
+		objects = objects[n:]
+	}
+	return nil
+}
+
+// ListPrefixes returns the sorted top level prefixes of a bucket
+func (b *memoryBackend) ListPrefixes(bucketName string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return nil, errBucketNotFound
+	}
+	found := make(map[string]bool)
+	var prefixes []string
+	for name := range bucket.objects {
+		i := strings.Index(name, "/")
+		if i < 0 || found[name[:i+1]] {
+			continue
+		}
+		found[name[:i+1]] = true
+		prefixes = append(prefixes, name[:i+1])
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// DeleteObjectVersion deletes an object from a bucket
+func (b *memoryBackend) DeleteObjectVersion(bucketName string, o objectVersion) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return errBucketNotFound
+	}
+	if _, ok := bucket.objects[o.Name]; !ok {
+		return errObjectNotFound
+	}
+	delete(bucket.objects, o.Name)
+	return nil
+}
+
+// ListBuckets returns the sorted names of the buckets starting with a prefix
+func (b *memoryBackend) ListBuckets(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.buckets {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// StatBucket returns the attributes of a bucket
+func (b *memoryBackend) StatBucket(bucketName string) (*bucketInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return nil, errBucketNotFound
+	}
+	info := &bucketInfo{
+		Name:         bucketName,
+		Location:     "MEMORY",
+		StorageClass: "STANDARD",
+		Created:      bucket.created,
+		Labels:       make(map[string]string),
+	}
+	for k, v := range bucket.labels {
+		info.Labels[k] = v
+	}
+	if bucket.opts.Location != "" {
+		info.Location = bucket.opts.Location
+	}
+	if bucket.opts.StorageClass != "" {
+		info.StorageClass = bucket.opts.StorageClass
+	}
+	return info, nil
+}
+
+// SetBucketLabels adds labels to a bucket
+func (b *memoryBackend) SetBucketLabels(bucketName string, labels map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return errBucketNotFound
+	}
+	for k, v := range labels {
+		bucket.labels[k] = v
+	}
+	return nil
+}
+
+// GetObject returns the content of an object of a bucket
+func (b *memoryBackend) GetObject(bucketName, objectName string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return nil, errBucketNotFound
+	}
+	data, ok := bucket.objects[objectName]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return data, nil
+}
+
+// PutObject stores an object into a bucket
+func (b *memoryBackend) PutObject(bucketName, objectName string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[bucketName]
+	if !ok {
+		return errBucketNotFound
+	}
+	bucket.objects[objectName] = data
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// selfMountInfoPath lists the mounts of the mount namespace of the driver
+	selfMountInfoPath = "/proc/self/mountinfo"
+	// procDir holds the processes of the host
+	procDir = "/proc"
+)
+
+// mountInfo is a mount of /proc/self/mountinfo
+type mountInfo struct {
+	Mountpoint string
+	FSType     string
+	Source     string
+}
+
+// isFuse returns true for a FUSE mount: fuse, fuse.gcsfuse, fuse.s3fs...
+func (m mountInfo) isFuse() bool {
+	return m.FSType == "fuse" || strings.HasPrefix(m.FSType, "fuse.")
+}
+
+// readMountInfo parses a mountinfo file:
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func readMountInfo(path string) ([]mountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// the optional fields end with a single hyphen, followed by the file system type & source
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			return nil, fmt.Errorf("Invalid mountinfo line: %s", scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			Mountpoint: unescapeMountPath(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes of a mountinfo path: \040 for a space...
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				buf.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(path[i])
+	}
+	return buf.String()
+}
+
+// fuseCommand is a running process of a FUSE tool
+type fuseCommand struct {
+	PID        int
+	Mountpoint string
+}
+
+// listFuseProcesses returns the running processes of a FUSE tool & their mountpoints,
+// found from the command lines of the processes: tool [flags] source mountpoint
+func listFuseProcesses(tool string) []fuseCommand {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil
+	}
+	var processes []fuseCommand
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if len(args) >= 2 && filepath.Base(args[0]) == tool {
+			processes = append(processes, fuseCommand{PID: pid, Mountpoint: filepath.Clean(args[len(args)-1])})
+		}
+	}
+	return processes
+}
+
+// findFuseProcess returns the PID of the process of a FUSE tool serving a mountpoint
+func findFuseProcess(tool, mountpoint string) (int, bool) {
+	for _, p := range listFuseProcesses(tool) {
+		if p.Mountpoint == mountpoint {
+			return p.PID, true
+		}
+	}
+	return 0, false
+}
+
+// isProcessAlive returns true while a process exists
+func isProcessAlive(pid int) bool {
+	_, err := os.Stat(filepath.Join(procDir, strconv.Itoa(pid)))
+	return err == nil
+}
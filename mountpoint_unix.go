@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// isMountpoint returns true if a dir is the root of a mounted file system: its device differs from its parent dir one,
+// a dead FUSE endpoint is an error
+func isMountpoint(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	parent, err := os.Stat(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return false, err
+	}
+	return uint64(info.Sys().(*syscall.Stat_t).Dev) != uint64(parent.Sys().(*syscall.Stat_t).Dev), nil
+}
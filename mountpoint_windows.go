@@ -0,0 +1,8 @@
+package main
+
+import "fmt"
+
+// isMountpoint fails, FUSE mountpoints are not supported on windows
+func isMountpoint(path string) (bool, error) {
+	return false, fmt.Errorf("Mountpoints are not supported on windows")
+}
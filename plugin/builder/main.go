@@ -0,0 +1,195 @@
+// builder assembles the managed Docker plugin of the volume driver, run from the repository root:
+//
+//	$ go run plugin/builder/main.go -create
+//
+// the rootfs is built from plugin/Dockerfile & exported with plugin/config.json into the plugin dir,
+// which is then optionally created as a plugin with `docker plugin create`
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	pluginName = flag.String("name", "craimbert/gcstorage", "Name of the plugin")
+	pluginTag  = flag.String("tag", "latest", "Tag of the plugin")
+	pluginDir  = flag.String("dir", filepath.Join("plugin", "build"), "Dir receiving the plugin config.json & rootfs")
+	create     = flag.Bool("create", false, "Create the plugin with docker plugin create once assembled")
+)
+
+func main() {
+	flag.Parse()
+	if _, err := os.Stat(filepath.Join("plugin", "config.json")); err != nil {
+		log.Fatalf("plugin/config.json not found, run the builder from the repository root: %s", err)
+	}
+	image := *pluginName + ":rootfs"
+
+	// build the rootfs image
+	if err := run("docker", "build", "-f", filepath.Join("plugin", "Dockerfile"), "-t", image, "."); err != nil {
+		log.Fatal(err)
+	}
+
+	// reset the plugin dir
+	rootfs := filepath.Join(*pluginDir, "rootfs")
+	if err := os.RemoveAll(*pluginDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	// export the filesystem of a container of the image into the rootfs
+	out, err := exec.Command("docker", "create", image).Output()
+	if err != nil {
+		log.Fatalf("docker create %s failed: %s", image, err)
+	}
+	containerID := strings.TrimSpace(string(out))
+	defer run("docker", "rm", "-f", containerID)
+	if err := exportRootfs(containerID, rootfs); err != nil {
+		log.Fatal(err)
+	}
+
+	// add the plugin config
+	config, err := ioutil.ReadFile(filepath.Join("plugin", "config.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*pluginDir, "config.json"), config, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Plugin assembled in %s\n", *pluginDir)
+
+	if *create {
+		name := *pluginName + ":" + *pluginTag
+		if err := run("docker", "plugin", "create", name, *pluginDir); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Plugin %s created, enable it with: docker plugin enable %s\n", name, name)
+	}
+}
+
+// run runs a command printing its output
+func run(name string, args ...string) error {
+	log.Printf("Running: $ %s %s\n", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %s", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// exportRootfs extracts the filesystem of a container into a dir
+func exportRootfs(containerID, rootfs string) error {
+	log.Printf("Exporting the filesystem of container %s into %s\n", containerID, rootfs)
+	cmd := exec.Command("docker", "export", containerID)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := untar(stdout, rootfs); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+// untar extracts a tar stream into a dir, the device nodes are skipped since docker creates them in the plugin;
+// the symlinks are created last so that no entry is extracted through a symlink of the archive
+func untar(r io.Reader, dir string) error {
+	dir = filepath.Clean(dir)
+	var symlinks []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, hdr.Name)
+		if !isWithinDir(dir, path) {
+			return fmt.Errorf("invalid path %s in the container filesystem", hdr.Name)
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode.Perm()); err != nil {
+				return err
+			}
+			// the dir may already exist, created for a previous entry
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			// set the setuid, setgid & sticky bits, and the permissions masked by the umask
+			if err := f.Chmod(mode); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// an absolute target is resolved from the root of the container filesystem
+			target := filepath.Join(filepath.Dir(path), hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) {
+				target = filepath.Join(dir, hdr.Linkname)
+			}
+			if !isWithinDir(dir, target) {
+				return fmt.Errorf("invalid symlink %s -> %s out of the container filesystem", hdr.Name, hdr.Linkname)
+			}
+			symlinks = append(symlinks, hdr)
+		case tar.TypeLink:
+			target := filepath.Join(dir, hdr.Linkname)
+			if !isWithinDir(dir, target) {
+				return fmt.Errorf("invalid hard link %s -> %s out of the container filesystem", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, hdr := range symlinks {
+		path := filepath.Join(dir, hdr.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isWithinDir returns true if a clean path is a dir or one of its descendants
+func isWithinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
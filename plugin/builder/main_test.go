@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test tar stream
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+// writeTar returns a tar stream of entries
+func writeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUntar(t *testing.T) {
+	rootfs := t.TempDir()
+	err := untar(writeTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, data: "busybox"},
+		{hdr: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox"}},
+		{hdr: tar.Header{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755}, data: "su"},
+		{hdr: tar.Header{Name: "bin/ash", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		{hdr: tar.Header{Name: "etc/motd", Typeflag: tar.TypeRegA, Mode: 0644}, data: "hello"},
+		{hdr: tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777}},
+		// the mode of a dir created for a previous entry is set by its own entry
+		{hdr: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0700}},
+	}), rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{
+		"bin/busybox": 0755,
+		"bin/su":      0755 | os.ModeSetuid,
+		"etc/motd":    0644,
+		"tmp":         0777 | os.ModeDir | os.ModeSticky,
+		"bin":         0700 | os.ModeDir,
+	}
+	for name, mode := range modes {
+		info, err := os.Lstat(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("%s has the mode %s, expected %s", name, info.Mode(), mode)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(rootfs, "bin/sh")); err != nil || target != "/bin/busybox" {
+		t.Errorf("symlink to %s: %v", target, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(rootfs, "bin/ash")); err != nil || string(data) != "busybox" {
+		t.Errorf("hard link content %q: %v", data, err)
+	}
+}
+
+func TestUntarRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		entry tar.Header
+		err   string
+	}{
+		{tar.Header{Name: "../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, "invalid path"},
+		{tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}, "invalid symlink"},
+		{tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}, "invalid hard link"},
+	}
+	for _, test := range tests {
+		parent := t.TempDir()
+		rootfs := filepath.Join(parent, "rootfs")
+		if err := os.Mkdir(rootfs, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := untar(writeTar(t, []tarEntry{{hdr: test.entry}}), rootfs)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("extracting %s: error %v, expected %s", test.entry.Name, err, test.err)
+		}
+		if entries, _ := ioutil.ReadDir(parent); len(entries) != 1 {
+			t.Errorf("extracting %s wrote out of the rootfs", test.entry.Name)
+		}
+	}
+}
+
+func TestUntarNeverFollowsSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	rootfs := t.TempDir()
+	// the absolute symlink targets a dir of the rootfs, but the same path out of the rootfs on the host
+	err := untar(writeTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "data", Typeflag: tar.TypeSymlink, Linkname: outside}},
+		{hdr: tar.Header{Name: "data/file", Typeflag: tar.TypeReg, Mode: 0644}, data: "data"},
+	}), rootfs)
+	if err == nil {
+		t.Error("symlink replaced by a dir of the archive")
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Error("file extracted through a symlink out of the rootfs")
+	}
+}
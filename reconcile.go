@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// reattacher is a Mounter which can supervise the FUSE process of a mountpoint started by a previous driver process
+type reattacher interface {
+	// Reattach supervises the FUSE process serving a mountpoint, it returns false if there is none
+	Reattach(v *gcsVolumes, mountpoint string) (bool, error)
+}
+
+// reconcileStats counts the outcomes of a mount reconciliation
+type reconcileStats struct {
+	Reattached int
+	Remounted  int
+	Unmounted  int
+	Terminated int
+}
+
+// reconcileMounts compares the persisted active mounts of the volumes with the mounts of the kernel,
+// after a driver crash or restart:
+// the live mounts of the mounted volumes are reattached, the dead FUSE endpoints are lazily unmounted & remounted,
+// the mounted volumes which are not mounted anymore are mounted again, the mounts no volume uses are unmounted
+// & the gcsfuse processes left without mount are terminated
+func (d *gcpVolDriver) reconcileMounts() reconcileStats {
+	var stats reconcileStats
+	mounts, err := readMountInfo(d.mountInfoPath)
+	if err != nil {
+		log.Printf("Reconciling mounts: reading %s failed, skipped: %s\n", d.mountInfoPath, err)
+		return stats
+	}
+	// the mounts of the driver root dir by mountpoint, the last mount of a mountpoint hides the previous ones
+	rootMounts := make(map[string]mountInfo)
+	for _, m := range mounts {
+		if strings.HasPrefix(m.Mountpoint, d.driverRootDir+string(filepath.Separator)) {
+			rootMounts[m.Mountpoint] = m
+		}
+	}
+	d.mu.Lock()
+	var names []string
+	volumes := make(map[string]*gcsVolumes)
+	for name, v := range d.mountedBuckets {
+		names = append(names, name)
+		volumes[name] = v
+	}
+	d.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		v := volumes[name]
+		mountpoint := d.getMountpoint(name)
+		m, mounted := rootMounts[mountpoint]
+		delete(rootMounts, mountpoint)
+		active := len(v.Mounts) > 0
+		switch {
+		case mounted && active:
+			if _, err := os.Stat(mountpoint); err != nil {
+				log.Printf("Reconciling mounts: volume '%s' has a dead %s endpoint (%s), remounting it\n", name, m.FSType, err)
+				lazyUnmount(mountpoint)
+				if d.remountVolume(v, mountpoint) {
+					stats.Remounted++
+				}
+				continue
+			}
+			if d.reattachVolume(v, mountpoint) {
+				stats.Reattached++
+			}
+		case mounted && !active:
+			if !m.isFuse() {
+				log.Printf("Reconciling mounts: volume '%s' is mounted (%s) without any active mount, kept\n", name, m.FSType)
+				continue
+			}
+			log.Printf("Reconciling mounts: volume '%s' is mounted (%s) without any active mount, unmounting it\n", name, m.FSType)
+			lazyUnmount(mountpoint)
+			stats.Unmounted++
+		case !mounted && active:
+			log.Printf("Reconciling mounts: volume '%s' has %d active mount(s) but is not mounted, mounting it\n", name, len(v.Mounts))
+			if d.remountVolume(v, mountpoint) {
+				stats.Remounted++
+			}
+		}
+	}
+	// mounts of the driver root dir left by removed volumes or by a lost state
+	var orphans []string
+	for mountpoint := range rootMounts {
+		orphans = append(orphans, mountpoint)
+	}
+	sort.Strings(orphans)
+	for _, mountpoint := range orphans {
+		m := rootMounts[mountpoint]
+		if !m.isFuse() {
+			log.Printf("Reconciling mounts: %s mount %s of %s does not belong to any volume, kept\n", m.FSType, mountpoint, m.Source)
+			continue
+		}
+		log.Printf("Reconciling mounts: %s mount %s of %s does not belong to any volume, unmounting it\n", m.FSType, mountpoint, m.Source)
+		lazyUnmount(mountpoint)
+		stats.Unmounted++
+	}
+	stats.Terminated = d.terminateOrphanFuseProcesses()
+	log.Printf("Reconciling mounts: %d reattached, %d remounted, %d unmounted, %d orphan gcsfuse process(es) terminated\n", stats.Reattached, stats.Remounted, stats.Unmounted, stats.Terminated)
+	return stats
+}
+
+// terminateOrphanFuseProcesses terminates the gcsfuse processes of the driver root dir serving no mount:
+// the processes which are not supervised for their mountpoint & whose mountpoint is not mounted,
+// such as the processes of a dead endpoint lazily unmounted or of a mount interrupted by a driver crash
+func (d *gcpVolDriver) terminateOrphanFuseProcesses() int {
+	if d.fuse == nil {
+		return 0
+	}
+	terminated := 0
+	for _, p := range listFuseProcesses("gcsfuse") {
+		if !strings.HasPrefix(p.Mountpoint, d.driverRootDir+string(filepath.Separator)) {
+			continue
+		}
+		if pid, ok := d.fuse.pid(p.Mountpoint); ok {
+			// a supervised process being launched or restarted is not known yet
+			if pid == 0 || pid == p.PID {
+				continue
+			}
+		} else if mounted, _ := isMountpoint(p.Mountpoint); mounted {
+			log.Printf("Reconciling mounts: gcsfuse process %d of mountpoint '%s' is not supervised, kept\n", p.PID, p.Mountpoint)
+			continue
+		}
+		log.Printf("Reconciling mounts: gcsfuse process %d of mountpoint '%s' serves no mount, terminating it\n", p.PID, p.Mountpoint)
+		if err := terminateProcess(p.PID); err != nil {
+			log.Printf("Reconciling mounts: terminating gcsfuse process %d failed: %s\n", p.PID, err)
+			continue
+		}
+		terminated++
+	}
+	return terminated
+}
+
+// reattachVolume supervises the live FUSE process of a mounted volume, returns true if reattached
+func (d *gcpVolDriver) reattachVolume(v *gcsVolumes, mountpoint string) bool {
+	b, err := d.getVolumeBackend(v.backendType(), v.identity())
+	if err != nil {
+		log.Printf("Reconciling mounts: volume '%s' cannot be reattached: %s\n", v.Volume.Name, err)
+		return false
+	}
+	r, ok := b.mounter.(reattacher)
+	if !ok {
+		// the FUSE tool daemonizes itself, its mount is kept as is
+		return false
+	}
+	ok, err = r.Reattach(v, mountpoint)
+	if err != nil {
+		log.Printf("Reconciling mounts: volume '%s' cannot be reattached: %s\n", v.Volume.Name, err)
+		return false
+	}
+	if !ok {
+		log.Printf("Reconciling mounts: no FUSE process found for the live mount of volume '%s', it is not supervised\n", v.Volume.Name)
+	}
+	return ok
+}
+
+// remountVolume mounts the bucket of a volume with active mounts, returns true if mounted
+func (d *gcpVolDriver) remountVolume(v *gcsVolumes, mountpoint string) bool {
+	b, err := d.getVolumeBackend(v.backendType(), v.identity())
+	if err == nil {
+		err = d.createMountpoint(mountpoint)
+	}
+	if err == nil {
+		err = b.mounter.Mount(v, mountpoint)
+	}
+	if err != nil {
+		log.Printf("Reconciling mounts: mounting volume '%s' failed: %s\n", v.Volume.Name, err)
+		return false
+	}
+	return true
+}
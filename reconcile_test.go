@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// writeTestMountInfo writes a mountinfo file listing mounts, returns its path
+func writeTestMountInfo(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	var data string
+	for _, line := range lines {
+		data += line + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadMountInfo(t *testing.T) {
+	path := writeTestMountInfo(t,
+		`36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue`,
+		// octal escapes of the space, tab & backslash; an invalid escape is kept as is
+		`37 36 0:45 / /var/lib/with\040space\011tab\134slash rw,nosuid - fuse.gcsfuse my\040bucket rw,user_id=0`,
+		`38 36 0:46 / /mnt/\777 rw - tmpfs tmpfs rw`,
+		// without any optional field, or with several of them
+		`39 36 0:47 / /mnt/s3 rw - fuse.s3fs s3fs rw`,
+		`40 36 0:48 / /mnt/fuse rw shared:2 master:3 propagate_from:4 unbindable - fuse /dev/fuse rw`,
+		`41 36 8:17 / /mnt/blk rw - fuseblk /dev/sdb1 rw`,
+	)
+	mounts, err := readMountInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []mountInfo{
+		{Mountpoint: "/mnt2", FSType: "ext3", Source: "/dev/root"},
+		{Mountpoint: "/var/lib/with space\ttab\\slash", FSType: "fuse.gcsfuse", Source: "my bucket"},
+		{Mountpoint: `/mnt/\777`, FSType: "tmpfs", Source: "tmpfs"},
+		{Mountpoint: "/mnt/s3", FSType: "fuse.s3fs", Source: "s3fs"},
+		{Mountpoint: "/mnt/fuse", FSType: "fuse", Source: "/dev/fuse"},
+		{Mountpoint: "/mnt/blk", FSType: "fuseblk", Source: "/dev/sdb1"},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("readMountInfo = %+v, expected %+v", mounts, expected)
+	}
+	for i, isFuse := range []bool{false, true, false, true, true, false} {
+		if i < len(mounts) && mounts[i].isFuse() != isFuse {
+			t.Errorf("%s mount of %s: isFuse %t, expected %t", mounts[i].FSType, mounts[i].Mountpoint, !isFuse, isFuse)
+		}
+	}
+
+	for _, line := range []string{
+		`36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw`,
+		`36 35 98:0 /mnt1 /mnt2 rw - ext3`,
+		`36 35 98:0 /mnt1`,
+	} {
+		if _, err := readMountInfo(writeTestMountInfo(t, line)); err == nil || !strings.HasPrefix(err.Error(), "Invalid mountinfo line") {
+			t.Errorf("mountinfo line %q: error %v", line, err)
+		}
+	}
+}
+
+func TestReconcileMounts(t *testing.T) {
+	rootDir := t.TempDir()
+	buckets := newMemoryBackend()
+	d := newTestDriverWith(t, rootDir, buckets, newDirMounter())
+	for _, name := range []string{"stale", "dead", "idle", "live"} {
+		if res := d.Create(volume.Request{Name: name}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	for _, name := range []string{"stale", "dead", "live"} {
+		if res := d.Mount(volume.Request{Name: name, MountID: "c1"}); res.Err != "" {
+			t.Fatal(res.Err)
+		}
+	}
+	// the driver restarts: the stale volume is not mounted anymore, the idle volume is mounted without container
+	// & the mount of a removed volume is left behind
+	mountLine := func(i int, mountpoint, fsType string) string {
+		return fmt.Sprintf("%d 1 0:%d / %s rw,nosuid,nodev - %s %s rw", 100+i, 50+i, mountpoint, fsType, fsType)
+	}
+	startupMounts := writeTestMountInfo(t,
+		mountLine(0, d.getMountpoint("dead"), "fuse.gcsfuse"),
+		mountLine(1, d.getMountpoint("idle"), "fuse.gcsfuse"),
+		mountLine(2, d.getMountpoint("live"), "fuse.s3fs"),
+		mountLine(3, d.getMountpoint("removed"), "fuse.gcsfuse"),
+		// the mounts which are not FUSE mounts or out of the driver root dir are never unmounted
+		mountLine(4, filepath.Join(rootDir, "bind"), "ext4"),
+		mountLine(5, "/mnt/other", "fuse.gcsfuse"),
+	)
+	mounter := newDirMounter()
+	restarted, err := newVolDriver(rootDir, "", testProjectID, map[string]*volumeBackend{
+		backendGCS: {buckets: buckets, mounter: mounter, bucketPrefix: testProjectID},
+	}, nil, nil, startupMounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mounter.isMounted(restarted.getMountpoint("stale")) {
+		t.Error("stale volume not mounted again")
+	}
+	// the live mounts of a FUSE tool daemonizing itself are kept as is
+	for _, name := range []string{"dead", "live"} {
+		if mounter.isMounted(restarted.getMountpoint(name)) {
+			t.Errorf("live volume %s mounted again", name)
+		}
+	}
+
+	// a dead FUSE endpoint cannot be stat-ed, like the missing mountpoint standing for it
+	if err := os.RemoveAll(restarted.getMountpoint("dead")); err != nil {
+		t.Fatal(err)
+	}
+	restarted.mountInfoPath = writeTestMountInfo(t,
+		mountLine(0, d.getMountpoint("dead"), "fuse.gcsfuse"),
+		mountLine(1, d.getMountpoint("idle"), "fuse.gcsfuse"),
+		mountLine(2, d.getMountpoint("live"), "fuse.s3fs"),
+		mountLine(3, d.getMountpoint("removed"), "fuse.gcsfuse"),
+		mountLine(6, d.getMountpoint("stale"), "fuse.gcsfuse"),
+	)
+	if stats := restarted.reconcileMounts(); stats != (reconcileStats{Remounted: 1, Unmounted: 2}) {
+		t.Errorf("reconciliation: %+v, expected the dead volume remounted, the idle & removed ones unmounted", stats)
+	}
+	if !mounter.isMounted(restarted.getMountpoint("dead")) {
+		t.Error("volume with a dead endpoint not mounted again")
+	}
+
+	// nothing changes once the kernel mounts match the active mounts
+	restarted.mountInfoPath = writeTestMountInfo(t,
+		mountLine(0, d.getMountpoint("dead"), "fuse.gcsfuse"),
+		mountLine(2, d.getMountpoint("live"), "fuse.s3fs"),
+		mountLine(6, d.getMountpoint("stale"), "fuse.gcsfuse"),
+	)
+	if stats := restarted.reconcileMounts(); stats != (reconcileStats{}) {
+		t.Errorf("reconciliation of matching mounts: %+v", stats)
+	}
+}
+
+// startFakeGcsfuse runs a process with the command line of a gcsfuse process serving a mountpoint,
+// killed at the end of the test
+func startFakeGcsfuse(t *testing.T, mountpoint string) *exec.Cmd {
+	t.Helper()
+	cmd := &exec.Cmd{
+		Path: "/bin/sh",
+		// the trailing command keeps sh from replacing itself with sleep
+		Args: []string{"gcsfuse", "-c", "sleep 30; :", "bucket", mountpoint},
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("/bin/sh cannot be run: %s", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-exited
+	})
+	// the command line is visible once sh runs
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if pid, ok := findFuseProcess("gcsfuse", mountpoint); ok && pid == cmd.Process.Pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fake gcsfuse process of %s not found", mountpoint)
+		}
+	}
+	return cmd
+}
+
+func TestTerminateOrphanFuseProcesses(t *testing.T) {
+	d, _, _ := newTestDriver(t)
+	d.fuse = newFuseSupervisor("")
+	orphan := startFakeGcsfuse(t, filepath.Join(d.driverRootDir, "orphan"))
+	supervised := startFakeGcsfuse(t, filepath.Join(d.driverRootDir, "supervised"))
+	outside := startFakeGcsfuse(t, filepath.Join(t.TempDir(), "outside"))
+	if err := d.fuse.adopt("supervised", filepath.Join(d.driverRootDir, "supervised"), "gcsfuse", supervised.Process.Pid, func() *exec.Cmd {
+		return exec.Command("false")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.fuse.shutdown()
+
+	if terminated := d.terminateOrphanFuseProcesses(); terminated != 1 {
+		t.Errorf("%d process(es) terminated instead of the orphan one", terminated)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := findFuseProcess("gcsfuse", filepath.Join(d.driverRootDir, "orphan")); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("orphan gcsfuse process %d still running", orphan.Process.Pid)
+		}
+	}
+	for _, cmd := range []*exec.Cmd{supervised, outside} {
+		if !isProcessAlive(cmd.Process.Pid) {
+			t.Errorf("gcsfuse process %d of %s terminated", cmd.Process.Pid, cmd.Args[len(cmd.Args)-1])
+		}
+	}
+}
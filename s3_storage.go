@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3EmptyPayloadHash is the SHA256 of an empty request body
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// s3DefaultRegion is the region of the buckets created without location constraint
+	s3DefaultRegion = "us-east-1"
+)
+
+// s3Config defines how to reach an S3 compatible object storage (AWS S3, MinIO...)
+type s3Config struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	BucketPrefix string
+	FuseTool     string
+}
+
+// s3Backend is the S3 implementation of BucketBackend, requests are signed with AWS Signature V4
+// and use path-style addressing so that any S3 compatible endpoint can be used
+type s3Backend struct {
+	conf   *s3Config
+	client *http.Client
+}
+
+// s3Error is the XML error document returned by S3
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 error: HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 error: HTTP %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// s3ListBucketResult is the XML document returned by a ListObjectsV2 request
+type s3ListBucketResult struct {
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3ListVersionsResult is the XML document returned by a ListObjectVersions request
+type s3ListVersionsResult struct {
+	Versions            []s3ObjectVersion `xml:"Version"`
+	DeleteMarkers       []s3ObjectVersion `xml:"DeleteMarker"`
+	IsTruncated         bool              `xml:"IsTruncated"`
+	NextKeyMarker       string            `xml:"NextKeyMarker"`
+	NextVersionIDMarker string            `xml:"NextVersionIdMarker"`
+}
+
+// s3ObjectVersion is an object version or a delete marker of a ListObjectVersions result
+type s3ObjectVersion struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId"`
+}
+
+// s3ListAllMyBucketsResult is the XML document returned by a ListBuckets request
+type s3ListAllMyBucketsResult struct {
+	Buckets []struct {
+		Name string `xml:"Name"`
+	} `xml:"Buckets>Bucket"`
+}
+
+// s3LocationConstraint is the XML document returned by a GetBucketLocation request
+type s3LocationConstraint struct {
+	Location string `xml:",chardata"`
+}
+
+// s3Tagging is the XML document of the PutBucketTagging & GetBucketTagging requests
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+// s3Tag is a key/value pair of an S3 tag set
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// newS3Backend creates an S3 backend from its configuration
+func newS3Backend(conf *s3Config) (*s3Backend, error) {
+	if _, err := url.Parse(conf.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %s", conf.Endpoint, err)
+	}
+	if conf.AccessKey == "" || conf.SecretKey == "" {
+		return nil, fmt.Errorf("S3 access key & secret key are required")
+	}
+	if conf.Region == "" {
+		conf.Region = s3DefaultRegion
+	}
+	log.Printf("S3 endpoint: %s (region %s)\n", conf.Endpoint, conf.Region)
+	return &s3Backend{
+		conf:   conf,
+		client: http.DefaultClient,
+	}, nil
+}
+
+// BucketExists returns true if an S3 bucket exists
+func (b *s3Backend) BucketExists(bucketName string) (bool, error) {
+	resp, err := b.do("HEAD", bucketName, "", nil, nil)
+	if err != nil {
+		if e, ok := err.(*s3Error); ok {
+			switch e.StatusCode {
+			case http.StatusNotFound:
+				log.Printf("There is no bucket named '%s' on S3\n", bucketName)
+				return false, nil
+			case http.StatusForbidden:
+				return false, errBucketForbidden
+			}
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	log.Printf("S3 bucket '%s' already exists\n", bucketName)
+	return true, nil
+}
+
+// CreateBucket creates an S3 bucket in the location defined for the volume, or in the configured region
+func (b *s3Backend) CreateBucket(bucketName string, opts *bucketOptions) error {
+	region := b.conf.Region
+	if opts.Location != "" {
+		region = opts.Location
+	}
+	var body []byte
+	if region != s3DefaultRegion {
+		body = []byte(fmt.Sprintf(
+			`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><LocationConstraint>%s</LocationConstraint></CreateBucketConfiguration>`,
+			region,
+		))
+	}
+	// the creation is signed for the region of the new bucket, S3 rejects it otherwise
+	resp, err := b.doIn(region, "PUT", bucketName, "", nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	log.Printf("S3 bucket '%s' created\n", bucketName)
+	return nil
+}
+
+// DeleteBucket deletes an empty S3 bucket
+func (b *s3Backend) DeleteBucket(bucketName string) error {
+	resp, err := b.do("DELETE", bucketName, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	log.Printf("S3 bucket '%s' deleted\n", bucketName)
+	return nil
+}
+
+// ListObjectVersions walks page by page all the versions & delete markers of the objects stored in an S3 bucket under a prefix
+func (b *s3Backend) ListObjectVersions(bucketName, prefix string, page func([]objectVersion) error) error {
+	query := url.Values{"versions": {""}, "prefix": {prefix}}
+	for {
+		var result s3ListVersionsResult
+		if err := b.doXML("GET", bucketName, "", query, &result); err != nil {
+			return err
+		}
+		var objects []objectVersion
+		for _, v := range append(result.Versions, result.DeleteMarkers...) {
+			objects = append(objects, objectVersion{Name: v.Key, Version: v.VersionID})
+		}
+		if len(objects) > 0 {
+			if err := page(objects); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		if result.NextVersionIDMarker != "" {
+			query.Set("version-id-marker", result.NextVersionIDMarker)
+		} else {
+			query.Del("version-id-marker")
+		}
+	}
+}
+
+// ListPrefixes returns the top level prefixes of an S3 bucket
+func (b *s3Backend) ListPrefixes(bucketName string) ([]string, error) {
+	var prefixes []string
+	err := b.listPages(bucketName, url.Values{"delimiter": {"/"}}, func(result *s3ListBucketResult) {
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+	})
+	return prefixes, err
+}
+
+// GetObject reads an object from an S3 bucket
+func (b *s3Backend) GetObject(bucketName, objectName string) ([]byte, error) {
+	resp, err := b.do("GET", bucketName, objectName, nil, nil)
+	if err != nil {
+		if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusNotFound {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// PutObject writes an object into an S3 bucket
+func (b *s3Backend) PutObject(bucketName, objectName string, data []byte) error {
+	resp, err := b.do("PUT", bucketName, objectName, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listPages walks all the pages of a ListObjectsV2 request
+func (b *s3Backend) listPages(bucketName string, query url.Values, page func(*s3ListBucketResult)) error {
+	query.Set("list-type", "2")
+	for {
+		var result s3ListBucketResult
+		if err := b.doXML("GET", bucketName, "", query, &result); err != nil {
+			return err
+		}
+		page(&result)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// DeleteObjectVersion permanently deletes a version of an object from an S3 bucket
+func (b *s3Backend) DeleteObjectVersion(bucketName string, o objectVersion) error {
+	var query url.Values
+	if o.Version != "" {
+		query = url.Values{"versionId": {o.Version}}
+	}
+	resp, err := b.do("DELETE", bucketName, o.Name, query, nil)
+	if err != nil {
+		if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusNotFound {
+			return errObjectNotFound
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListBuckets returns the names of the S3 buckets of the account starting with a prefix
+func (b *s3Backend) ListBuckets(prefix string) ([]string, error) {
+	var result s3ListAllMyBucketsResult
+	if err := b.doXML("GET", "", "", nil, &result); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, bucket := range result.Buckets {
+		if strings.HasPrefix(bucket.Name, prefix) {
+			names = append(names, bucket.Name)
+		}
+	}
+	return names, nil
+}
+
+// StatBucket returns the attributes of an S3 bucket
+func (b *s3Backend) StatBucket(bucketName string) (*bucketInfo, error) {
+	exist, err := b.BucketExists(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, errBucketNotFound
+	}
+	var location s3LocationConstraint
+	if err := b.doXML("GET", bucketName, "", url.Values{"location": {""}}, &location); err != nil {
+		return nil, err
+	}
+	if location.Location == "" {
+		location.Location = s3DefaultRegion
+	}
+	labels, err := b.getBucketTags(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketInfo{
+		Name:         bucketName,
+		Location:     location.Location,
+		StorageClass: "STANDARD",
+		Labels:       labels,
+	}, nil
+}
+
+// SetBucketLabels adds labels to an S3 bucket as bucket tags
+func (b *s3Backend) SetBucketLabels(bucketName string, labels map[string]string) error {
+	tags, err := b.getBucketTags(bucketName)
+	if err != nil {
+		return err
+	}
+	for k, v := range labels {
+		tags[k] = v
+	}
+	tagging := &s3Tagging{}
+	for k, v := range tags {
+		tagging.TagSet = append(tagging.TagSet, s3Tag{Key: k, Value: v})
+	}
+	sort.Slice(tagging.TagSet, func(i, j int) bool { return tagging.TagSet[i].Key < tagging.TagSet[j].Key })
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do("PUT", bucketName, "", url.Values{"tagging": {""}}, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	log.Printf("S3 Bucket '%s' tagged: %v\n", bucketName, labels)
+	return nil
+}
+
+// getBucketTags returns the tags of an S3 bucket, a bucket without tags returns an empty map
+func (b *s3Backend) getBucketTags(bucketName string) (map[string]string, error) {
+	tags := make(map[string]string)
+	var tagging s3Tagging
+	if err := b.doXML("GET", bucketName, "", url.Values{"tagging": {""}}, &tagging); err != nil {
+		if e, ok := err.(*s3Error); ok && e.Code == "NoSuchTagSet" {
+			return tags, nil
+		}
+		return nil, err
+	}
+	for _, tag := range tagging.TagSet {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+// doXML sends a signed request to S3 & decodes the XML response into v
+func (b *s3Backend) doXML(method, bucketName, key string, query url.Values, v interface{}) error {
+	resp, err := b.do(method, bucketName, key, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends a request signed for the configured region to S3, non 2xx responses are returned as *s3Error
+func (b *s3Backend) do(method, bucketName, key string, query url.Values, body []byte) (*http.Response, error) {
+	return b.doIn(b.conf.Region, method, bucketName, key, query, body)
+}
+
+// doIn sends a request signed for a region to S3, non 2xx responses are returned as *s3Error
+func (b *s3Backend) doIn(region, method, bucketName, key string, query url.Values, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(b.conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + s3URIEncode(bucketName, false)
+	if key != "" {
+		path += "/" + s3URIEncode(key, false)
+	}
+	rawQuery := s3CanonicalQuery(query)
+	u := endpoint.Scheme + "://" + endpoint.Host + path
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		// required by some S3 requests such as PutBucketTagging
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	b.sign(req, region, path, rawQuery, body, time.Now().UTC())
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		e := &s3Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature V4 headers to an S3 request sent to a region
+func (b *s3Backend) sign(req *http.Request, region, path, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := s3EmptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+b.conf.SecretKey), date)
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.conf.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+// s3HMAC returns the HMAC-SHA256 of data with key
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes a query string sorted by key as expected by AWS Signature V4
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3URIEncode percent-encodes every byte except the unreserved characters (and '/' unless encodeSlash)
+func s3URIEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+const (
+	// s3FuseS3fs mounts S3 buckets using s3fs-fuse
+	s3FuseS3fs = "s3fs"
+	// s3FuseGoofys mounts S3 buckets using goofys
+	s3FuseGoofys = "goofys"
+)
+
+// s3Mounter mounts S3 buckets using s3fs or goofys
+type s3Mounter struct {
+	conf *s3Config
+}
+
+// newS3Mounter creates an S3 mounter using the FUSE tool defined in the S3 configuration
+func newS3Mounter(conf *s3Config) (*s3Mounter, error) {
+	switch conf.FuseTool {
+	case "":
+		conf.FuseTool = s3FuseS3fs
+	case s3FuseS3fs, s3FuseGoofys:
+	default:
+		return nil, fmt.Errorf("unsupported S3 FUSE tool %s, use %s or %s", conf.FuseTool, s3FuseS3fs, s3FuseGoofys)
+	}
+	return &s3Mounter{
+		conf: conf,
+	}, nil
+}
+
+// Mount mounts an S3 bucket on a host dir
+func (s *s3Mounter) Mount(v *gcsVolumes, mountpoint string) error {
+	var cmd *exec.Cmd
+	switch s.conf.FuseTool {
+	case s3FuseGoofys:
+		bucket := v.GcsBucketName
+		if v.Prefix != "" {
+			bucket += ":" + v.Prefix
+		}
+		cmd = exec.Command("goofys", "--endpoint", s.conf.Endpoint, "--region", s.conf.Region, bucket, mountpoint)
+		cmd.Env = append(os.Environ(),
+			"AWS_ACCESS_KEY_ID="+s.conf.AccessKey,
+			"AWS_SECRET_ACCESS_KEY="+s.conf.SecretKey,
+		)
+	default:
+		bucket := v.GcsBucketName
+		if v.Prefix != "" {
+			bucket += ":/" + v.Prefix
+		}
+		cmd = exec.Command("s3fs", bucket, mountpoint,
+			"-o", "url="+s.conf.Endpoint,
+			"-o", "endpoint="+s.conf.Region,
+			"-o", "use_path_request_style",
+		)
+		cmd.Env = append(os.Environ(),
+			"AWSACCESSKEYID="+s.conf.AccessKey,
+			"AWSSECRETACCESSKEY="+s.conf.SecretKey,
+		)
+	}
+	log.Printf("Mounting host mountpoint '%s' to S3 Bucket '%s'\n", mountpoint, v.GcsBucketName)
+	log.Printf("Running: $ %v\n", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unmount unmounts a mounted S3 bucket on a host dir
+func (s *s3Mounter) Unmount(mountpoint string) error {
+	return fusermountUnmount(mountpoint)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// volumeMarkerName is the name of the marker object written in the prefix of a volume stored in a shared bucket
+const volumeMarkerName = ".docker-volume-gcstorage"
+
+// volumeMarker is the content of the marker object of a volume stored in a shared bucket,
+// it makes an empty volume visible as a prefix & carries the volume options to the other hosts
+type volumeMarker struct {
+	Name      string            `json:"name"`
+	Options   map[string]string `json:"options,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// getVolumeMarkerName returns the marker object name of a volume stored under a prefix
+func getVolumeMarkerName(prefix string) string {
+	return prefix + "/" + volumeMarkerName
+}
+
+// readVolumeMarker reads the marker object of a volume stored in a shared bucket, errObjectNotFound if it does not exist
+func (d *gcpVolDriver) readVolumeMarker(b *volumeBackend, volumeName string) (*volumeMarker, error) {
+	data, err := b.buckets.GetObject(b.sharedBucket, getVolumeMarkerName(volumeName))
+	if err != nil {
+		return nil, err
+	}
+	var marker volumeMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, err
+	}
+	return &marker, nil
+}
+
+// writeVolumeMarker writes the marker object of a volume stored in a shared bucket
+func (d *gcpVolDriver) writeVolumeMarker(b *volumeBackend, v *gcsVolumes) error {
+	data, err := json.Marshal(&volumeMarker{
+		Name:      v.Volume.Name,
+		Options:   v.Options,
+		CreatedAt: v.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing marker of volume '%s' into shared bucket '%s'\n", v.Volume.Name, v.GcsBucketName)
+	return b.buckets.PutObject(v.GcsBucketName, getVolumeMarkerName(v.Prefix), data)
+}
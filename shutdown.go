@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errShuttingDown is the error of the Docker requests received while the driver shuts down
+const errShuttingDown = "The volume driver is shutting down"
+
+// beginRequest references an in-flight Docker request, it returns false once the driver shuts down
+func (d *gcpVolDriver) beginRequest() bool {
+	d.requestsMu.Lock()
+	defer d.requestsMu.Unlock()
+	if d.closing {
+		return false
+	}
+	d.requests.Add(1)
+	return true
+}
+
+// endRequest dereferences an in-flight Docker request
+func (d *gcpVolDriver) endRequest() {
+	d.requests.Done()
+}
+
+// shutdown prepares the driver to exit: the new Docker requests are refused, the in-flight ones are drained
+// for at most timeout & the state is persisted; the mounted volumes are left mounted for the next driver process,
+// if unmount is true the FUSE mounts no container uses are unmounted, the volumes with active mounts always stay mounted
+func (d *gcpVolDriver) shutdown(timeout time.Duration, unmount bool) {
+	d.requestsMu.Lock()
+	d.closing = true
+	d.requestsMu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		d.requests.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Println("Shutdown: in-flight requests drained")
+	case <-time.After(timeout):
+		log.Printf("Shutdown: in-flight requests not drained after %s\n", timeout)
+		// the volumes of the in-flight requests are locked, unmounting them could block forever
+		unmount = false
+	}
+	d.mu.Lock()
+	if err := d.state.save(d.mountedBuckets); err != nil {
+		log.Printf("Shutdown: persisting the state failed: %s\n", err)
+	}
+	var mounted []string
+	inUse := make(map[string]bool)
+	for name, v := range d.mountedBuckets {
+		if len(v.Mounts) > 0 {
+			mounted = append(mounted, name)
+			inUse[d.getMountpoint(name)] = true
+		}
+	}
+	d.mu.Unlock()
+	sort.Strings(mounted)
+	if unmount {
+		log.Printf("Shutdown: %d unused FUSE mount(s) unmounted\n", d.unmountUnusedFuseMounts(inUse))
+	}
+	if d.fuse != nil {
+		d.fuse.shutdown()
+	}
+	log.Printf("Shutdown: %d volume(s) with active mounts\n", len(mounted))
+}
+
+// unmountUnusedFuseMounts unmounts the FUSE mounts of the driver root dir which are not in use by a container,
+// returns their number; the mounts in use are never unmounted, since their containers would lose their volume
+func (d *gcpVolDriver) unmountUnusedFuseMounts(inUse map[string]bool) int {
+	mounts, err := readMountInfo(d.mountInfoPath)
+	if err != nil {
+		log.Printf("Shutdown: reading %s failed, no mount unmounted: %s\n", d.mountInfoPath, err)
+		return 0
+	}
+	var unused []string
+	seen := make(map[string]bool)
+	for _, m := range mounts {
+		if !m.isFuse() || !strings.HasPrefix(m.Mountpoint, d.driverRootDir+string(filepath.Separator)) {
+			continue
+		}
+		if inUse[m.Mountpoint] || seen[m.Mountpoint] {
+			continue
+		}
+		seen[m.Mountpoint] = true
+		unused = append(unused, m.Mountpoint)
+	}
+	sort.Strings(unused)
+	unmounted := 0
+	for _, mountpoint := range unused {
+		if d.fuse != nil {
+			// a supervised process must not be restarted once unmounted
+			err = d.fuse.stop(mountpoint, fusermountUnmount)
+		} else {
+			err = fusermountUnmount(mountpoint)
+		}
+		if err != nil {
+			log.Printf("Shutdown: unused FUSE mount %s left mounted: %s\n", mountpoint, err)
+			continue
+		}
+		unmounted++
+	}
+	return unmounted
+}
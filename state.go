@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// stateFileName is the name of the driver metadata file stored in the driver root dir
+	stateFileName = "gcstorage.json"
+	// stateVersion is the format version of the driver metadata file
+	stateVersion = 1
+)
+
+// driverState is the on-disk representation of the volumes known by the driver
+type driverState struct {
+	Version int                    `json:"version"`
+	Volumes map[string]*gcsVolumes `json:"volumes"`
+}
+
+// stateStore persists the driver volumes into a JSON file
+type stateStore struct {
+	path string
+}
+
+// newStateStore creates a state store backed by a JSON file located in the driver root dir
+func newStateStore(driverRootDir string) *stateStore {
+	return &stateStore{
+		path: filepath.Join(driverRootDir, stateFileName),
+	}
+}
+
+// exists returns true if the state file has already been written on the host
+func (s *stateStore) exists() (bool, error) {
+	_, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// load reads the volumes stored in the state file, an empty map is returned if there is no state file
+func (s *stateStore) load() (map[string]*gcsVolumes, error) {
+	volumes := make(map[string]*gcsVolumes)
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return volumes, nil
+		}
+		return nil, err
+	}
+	var state driverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	for name, v := range state.Volumes {
+		volumes[name] = v
+	}
+	log.Printf("State: %d volume(s) loaded from %s\n", len(volumes), s.path)
+	return volumes, nil
+}
+
+// save atomically replaces the state file with the given volumes:
+// the state is written into a temporary file which is then renamed over the previous one
+func (s *stateStore) save(volumes map[string]*gcsVolumes) error {
+	data, err := json.MarshalIndent(&driverState{
+		Version: stateVersion,
+		Volumes: volumes,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, stateFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// loadState loads the driver volumes from the state file,
+// the first time the driver runs without a state file the existing volumes are looked up from the host
+func (d *gcpVolDriver) loadState() error {
+	exist, err := d.state.exists()
+	if err != nil {
+		return err
+	}
+	if !exist {
+		log.Printf("State: no state file %s, looking up existing volumes on the host\n", d.state.path)
+		if err := d.syncWithHost(); err != nil {
+			return err
+		}
+		return d.state.save(d.mountedBuckets)
+	}
+	volumes, err := d.state.load()
+	if err != nil {
+		return err
+	}
+	var dropped bool
+	for name, v := range volumes {
+		if err := validateVolumeName(name); err != nil {
+			log.Printf("State: %s, volume dropped\n", err)
+			delete(volumes, name)
+			dropped = true
+			continue
+		}
+		log.Printf("State: existing volume '%s' loaded (bucket '%s')\n", name, v.GcsBucketName)
+		if v.Discovered {
+			// the volume may have been removed by another host while this driver was down
+			ok, err := d.checkDiscoveredVolume(v)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				delete(volumes, name)
+				dropped = true
+				continue
+			}
+		}
+		if v.Removing {
+			// the bucket may already be deleted, the removal is resumed by the next Remove
+			log.Printf("State: volume '%s' is partially removed, remove it again\n", name)
+			continue
+		}
+		// recreate the host mountpoint if it disappeared
+		m := d.getMountpoint(name)
+		exist, err := d.isPathExist(m)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			if err := d.createMountpoint(m); err != nil {
+				return err
+			}
+		}
+		// create the bucket of that volume if not exist
+		opts, err := parseBucketOptions(v.backendType(), v.Options)
+		if err != nil {
+			return err
+		}
+		if v.ExternalBucket {
+			// a bucket not created by the driver is never created again
+			if _, err := d.handleAttachBucket(v.backendType(), v.identity(), v.GcsBucketName, opts); err != nil {
+				log.Printf("State: volume '%s': %s\n", name, err)
+			}
+			continue
+		}
+		if v.SharedBucket || v.Discovered {
+			// a shared bucket is never created by the driver, the bucket of a volume of another host is checked above
+			continue
+		}
+		userLabels, err := parseUserLabels(v.Options)
+		if err != nil {
+			return err
+		}
+		_, labels, err := d.handleCreateBucket(v.backendType(), v.identity(), name, opts, userLabels)
+		if err != nil {
+			return err
+		}
+		if v.Labels == nil {
+			// the bucket was created by the driver before the ownership labels were introduced
+			if err := d.migrateBucketLabels(v, labels, userLabels); err != nil {
+				return err
+			}
+		}
+	}
+	d.mountedBuckets = volumes
+	if dropped {
+		return d.state.save(d.mountedBuckets)
+	}
+	return nil
+}
+
+// checkDiscoveredVolume returns false if a volume created by another host is not found on the backends anymore,
+// its host mountpoint is then deleted; a volume with active mounts is always kept
+func (d *gcpVolDriver) checkDiscoveredVolume(v *gcsVolumes) (bool, error) {
+	name := v.Volume.Name
+	_, found, err := d.discoverVolume(name)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return true, nil
+	}
+	if len(v.Mounts) > 0 {
+		log.Printf("State: volume '%s' was removed from the backend by another host but has %d active mount(s), kept\n", name, len(v.Mounts))
+		return true, nil
+	}
+	log.Printf("State: volume '%s' was removed from the backend by another host, dropped\n", name)
+	if err := d.handleDeleteMountpoint(name); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// migrateBucketLabels stamps the driver ownership labels on the bucket of a volume created without labels
+func (d *gcpVolDriver) migrateBucketLabels(v *gcsVolumes, labels, userLabels map[string]string) error {
+	if !isDriverOwned(labels) {
+		b, err := d.getVolumeBackend(v.backendType(), v.identity())
+		if err != nil {
+			return err
+		}
+		labels = getBucketLabels(v.Volume.Name, userLabels)
+		if err := b.buckets.SetBucketLabels(v.GcsBucketName, labels); err != nil {
+			return err
+		}
+		log.Printf("State: bucket '%s' of volume '%s' labeled as owned by the driver\n", v.GcsBucketName, v.Volume.Name)
+	}
+	v.Labels = labels
+	return nil
+}